@@ -1,92 +1,479 @@
 package client
 
 import (
+	"crypto/tls"
 	"errors"
 	"github.com/ricochet2200/gun/msg"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
+// Transaction timeout for reliable transports, Ti in RFC 5389 section 7.2.2
+const TCPTimeout = 39500 * time.Millisecond
+
+// Most 300 Try Alternate redirects followed for one request
+const MaxRedirects = 3
+
+// Returned when a response to a signed request is not signed, which means
+// anyone could have sent it
+var ErrNoIntegrity = errors.New("Response without integrity")
+
 type Client struct {
 	server                     string
+	network                    string
 	user                       *msg.UserAttr
 	realm                      *msg.RealmAttr
 	nonce                      *msg.NonceAttr
+	algorithm                  msg.PasswordAlgorithmID
+	algorithms                 *msg.PasswordAlgorithmsAttr
 	password                   string
+	tlsConfig                  *tls.Config
+	fingerprint                bool
+	software                   *msg.SoftwareAttr
+	authLock                   sync.Mutex
+	rtoLock                    sync.Mutex
+	rto                        map[string]*rtoEstimator
 }
 
+// Creates a client that sends each request over a new TCP connection
 func NewClient(server, user, passwd string) (*Client, error) {
+	return newClient("tcp", server, user, passwd)
+}
+
+// Creates a client that sends requests over UDP, retransmitting them until a
+// response arrives
+func NewUDPClient(server, user, passwd string) (*Client, error) {
+	return newClient("udp", server, user, passwd)
+}
+
+// Creates a client that sends each request over a new TLS connection.  config
+// may be nil.  Unless it names a server, certificates are checked against the
+// host in server, also those of servers redirected to, RFC 5389 section 11.
+func NewTLSClient(server, user, passwd string, config *tls.Config) (*Client, error) {
+	c, err := newClient("tls", server, user, passwd)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	c.tlsConfig = config
+	return c, nil
+}
+
+// Adds a FINGERPRINT to every request when use is true.  Responses that carry
+// a fingerprint are always checked and dropped if it does not match.
+func (this *Client) UseFingerprint(use bool) {
+	this.fingerprint = use
+}
+
+// Adds a SOFTWARE attribute describing the client to every request, an empty
+// description removes it
+func (this *Client) SetSoftware(description string) error {
+
+	if description == "" {
+		this.software = nil
+		return nil
+	}
+
+	s, err := msg.NewSoftware(description)
+	if err != nil {
+		return err
+	}
+	this.software = s
+	return nil
+}
+
+func newClient(network, server, user, passwd string) (*Client, error) {
 
 	userAttr, err := msg.NewUser(user)
 	if err != nil {
 		return nil, err
 	}
 
-	//TODO: SASLPrep the password
-	return &Client{server, userAttr, nil, nil, passwd}, nil
+	passwd, err = msg.PrepareOpaque(passwd)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		server:   server,
+		network:  network,
+		user:     userAttr,
+		password: passwd,
+		rto:      map[string]*rtoEstimator{},
+	}, nil
+}
+
+func (this *Client) dial(server string) (*Connection, error) {
+
+	if this.network == "udp" {
+		addr, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			return nil, err
+		}
+
+		pc, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, err
+		}
+		return &Connection{Packet: pc, Addr: addr}, nil
+	}
+
+	if this.network == "tls" {
+		dialer := &net.Dialer{Timeout: 15 * time.Second}
+		conn, err := tls.DialWithDialer(dialer, "tcp", server, this.tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &Connection{Out: conn}, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", server, 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &Connection{Out: conn}, nil
+}
+
+// Sends req over conn and waits for the matching response
+func (this *Client) roundTrip(conn *Connection, req *msg.Message) (*msg.Message, error) {
+
+	if conn.Packet != nil {
+		send := func(b []byte) error {
+			_, err := conn.Packet.WriteTo(b, conn.Addr)
+			return err
+		}
+		return this.retransmit(conn.Addr.String(), req, send, readResponse(conn.Packet, req))
+	}
+
+	conn.Out.SetDeadline(time.Now().Add(TCPTimeout))
+	defer conn.Out.SetDeadline(time.Time{})
+
+	if _, err := conn.Out.Write(req.EncodeMessage()); err != nil {
+		return nil, err
+	}
+	return msg.DecodeMessage(conn.Out)
 }
 
-// Sends a request where you expect to get a response back
+// Sends a request where you expect to get a response back.  Challenges for
+// credentials are answered and 300 Try Alternate redirects are followed.
 func (this *Client) SendReqRes(req *msg.Message) (*Connection, error) {
 
-	conn, err := net.DialTimeout("tcp", this.server, 15*time.Second)
+	first, err := net.ResolveUDPAddr("udp", this.server)
+	if err != nil {
+		return nil, err
+	}
+	return this.sendTo(this.server, req, []*net.UDPAddr{first}, challenges{})
+}
+
+// visited holds the address of every server the request has gone to, to
+// catch redirect loops, and seen the challenges it has been resent after by
+// this one
+func (this *Client) sendTo(server string, req *msg.Message, visited []*net.UDPAddr, seen challenges) (*Connection, error) {
+
+	conn, err := this.dial(server)
 	if err != nil {
 		log.Println("Failed to create connection: ", err)
 		return nil, err
 	}
 
-	laddr := conn.LocalAddr()
-	ip := laddr.(*net.TCPAddr).IP
-	port := laddr.(*net.TCPAddr).Port
+	ip, port := addrIPPort(conn.LocalAddr())
 
 	xor := msg.NewXORAddress(ip, port, req.Header())
 	req.AddAttribute(xor)
+	this.sign(req)
+
+	res, err := this.roundTrip(conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.Res = res
+
+	if err := this.verify(res, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	retry, err := this.challenged(res, req, &seen)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	} else if retry {
+		conn.Close()
+		if err := this.updateCredentials(res); err != nil {
+			return nil, err
+		}
+		return this.sendTo(server, resend(req), visited, seen)
+	}
+
+	alt, err := this.redirected(res)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	} else if alt != nil {
+		conn.Close()
+		if len(visited) > MaxRedirects {
+			return nil, errors.New("Too many redirects")
+		}
+
+		// Compared as addresses, as the same one can be written many ways
+		for _, v := range visited {
+			if sameAddr(v, alt) {
+				return nil, errors.New("Redirect loop through " + alt.String())
+			}
+		}
+
+		log.Println("Redirected to", alt)
+		return this.sendTo(alt.String(), resend(req), append(visited, alt), challenges{})
+	}
+
+	if err := responseError(res); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// The *msg.StunError of an error response, nil if res is not one.  Callers can
+// find the code with errors.As.
+func responseError(res *msg.Message) error {
+
+	if res.Type()&msg.ClassMask != msg.Error {
+		return nil
+	}
+
+	a, err := res.Attribute(msg.ErrorCode)
+	if err != nil {
+		return errors.New("Error response without error code")
+	}
+
+	e, ok := a.(*msg.StunError)
+	if !ok {
+		return errors.New("Error response without error code")
+	}
+	return e
+}
+
+// A copy of req with a new transaction id
+func resend(req *msg.Message) *msg.Message {
+	ret := msg.NewRequest(req.Type())
+	ret.CopyAttributes(req)
+	return ret
+}
+
+// The server a 300 Try Alternate response sends the request to, nil if res
+// is something else.  Anyone could send an unsigned redirect, RFC 5389
+// section 11, so verify only lets through signed ones to signed requests.
+func (this *Client) redirected(res *msg.Message) (*net.UDPAddr, error) {
+
+	code, _, err := res.ErrorCode()
+	if err != nil || code != msg.TryAlternative {
+		return nil, nil
+	}
+
+	alt, err := res.AlternateServer()
+	if err != nil {
+		return nil, err
+	}
+	return &alt, nil
+}
+
+// Adds the long term credentials, once the server has sent a realm and nonce,
+// and the fingerprint if enabled.  Must be called after every other attribute
+// has been added.
+func (this *Client) sign(req *msg.Message) {
+
+	if this.software != nil {
+		req.AddAttribute(this.software)
+	}
+
+	this.authLock.Lock()
+	defer this.authLock.Unlock()
 
 	if this.nonce != nil && this.realm != nil {
-		req.AddAttribute(this.user)
+		// Servers that can look up a USERHASH never see the username
+		if this.nonce.Features()&msg.FeatureUsernameAnonymity != 0 {
+			req.RemoveAttribute(msg.Username)
+			req.AddAttribute(msg.NewUserHash(this.user.String(), this.realm.String()))
+		} else {
+			req.RemoveAttribute(msg.UserHash)
+			req.AddAttribute(this.user)
+		}
 		req.AddAttribute(this.realm)
 		req.AddAttribute(this.nonce)
 
-		username := this.user.String()
-		realm := this.realm.String()
+		// Requests resent after a challenge still carry the old integrity
+		req.RemoveAttribute(msg.MessageIntegrity)
+		req.RemoveAttribute(msg.MessageIntegritySHA256)
+
+		if this.algorithms != nil {
+			req.AddAttribute(msg.NewPasswordAlgorithm(this.algorithm))
+			req.AddAttribute(this.algorithms)
+			req.AddAttribute(msg.NewIntegritySHA256(this.key(), req))
+		} else {
+			req.AddAttribute(msg.NewIntegrityAttrKey(this.key(), req))
+		}
+	}
+
+	if this.fingerprint {
+		req.AddFingerprint()
+	}
+}
+
+// The long term key, authLock must be held
+func (this *Client) key() []byte {
+	return msg.PasswordKey(this.algorithm, this.user.String(), this.realm.String(), this.password)
+}
+
+func signed(m *msg.Message) bool {
+	_, err := m.Attribute(msg.MessageIntegrity)
+	_, shaErr := m.Attribute(msg.MessageIntegritySHA256)
+	return err == nil || shaErr == nil
+}
+
+// Checks the integrity of a response to a request that carried one, using the
+// same key.  Responses with attributes that must be understood but are not
+// fail too, RFC 5389 section 7.3.3.
+func (this *Client) verify(res, req *msg.Message) error {
+
+	if unknown := res.UnknownRequired(); len(unknown) > 0 {
+		return errors.New("Response has unknown attributes: " + msg.NewUnknownAttributes(unknown).String())
+	}
 
-		integrity := msg.NewIntegrityAttr(username, this.password, realm, req)
-		req.AddAttribute(integrity)
+	if !signed(req) {
+		return nil
+	} else if !signed(res) {
+		if unsignedError(res) {
+			return nil
+		}
+		return ErrNoIntegrity
 	}
 
-	conn.Write(req.EncodeMessage())
+	this.authLock.Lock()
+	key := this.key()
+	this.authLock.Unlock()
+
+	valid := false
+	if i, err := res.Attribute(msg.MessageIntegritySHA256); err == nil {
+		valid = i.(*msg.IntegritySHA256Attr).ValidKey(key, res)
+	} else if i, err := res.Attribute(msg.MessageIntegrity); err == nil {
+		valid = msg.ToIntegrity(i).ValidKey(key, res)
+	}
 
-	res, err := msg.DecodeMessage(conn)
+	if !valid {
+		return errors.New("Response failed integrity check")
+	}
+	return nil
+}
 
+// Errors a server may send unsigned to a signed request, as it could not or
+// need not check the credentials, RFC 5389 section 10.2.2
+func unsignedError(res *msg.Message) bool {
+
+	if res.Type()&msg.ClassMask != msg.Error {
+		return false
+	}
+
+	code, _, err := res.ErrorCode()
 	if err != nil {
-		conn.Close()
-		return nil, err
+		return false
 	}
 
-	if eattr, err := res.Attribute(msg.ErrorCode); err == nil {
-		if code, err := eattr.(*msg.StunError).Code(); err == nil {
-			log.Println("error code", code)
-			switch code {
+	switch code {
+	case msg.BadRequest, msg.Unauthorized, msg.UnknownAttribute, msg.StaleNonce:
+		return true
+	}
+	return false
+}
+
+// The challenges a request has been resent after.  Each is answered once, so
+// a server repeating one cannot keep the client resending forever.
+type challenges struct {
+	unauthorized bool
+	stale        bool
+}
+
+// Returns true if res rejected req in a way that sending it again with the
+// realm and nonce from res could fix, and that has not been tried yet
+func (this *Client) challenged(res, req *msg.Message, seen *challenges) (bool, error) {
 
-			case msg.StaleNonce:
-				log.Println("Stale Nonce, calling authenticate...")
-				return this.Authenticate(res, req)
+	if code, _, err := res.ErrorCode(); err == nil {
+		log.Println("error code", code)
+		switch code {
 
-			case msg.Unauthorized:
-				log.Println("unauthorized")
+		case msg.StaleNonce:
+			log.Println("Stale Nonce, calling authenticate...")
+			if seen.stale {
+				return false, responseError(res)
+			}
+			seen.stale = true
+			return true, nil
+
+		case msg.Unauthorized:
+			log.Println("unauthorized")
 
-				if _, err := req.Attribute(msg.MessageIntegrity); err == nil {
-					conn.Close()
-					return nil, errors.New("Invalid credentials")
-				} else {
-					return this.Authenticate(res, req)
-				}
+			// The credentials were tried and are wrong
+			if signed(req) || seen.unauthorized {
+				return false, responseError(res)
 			}
+			seen.unauthorized = true
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Stores the realm and nonce from a 401 or 438 response, and picks the
+// strongest password algorithm the server offers
+func (this *Client) updateCredentials(res *msg.Message) error {
+
+	r, rErr := res.Attribute(msg.Realm)
+	nonce, nErr := res.Attribute(msg.Nonce)
+	if rErr != nil || nErr != nil {
+		return errors.New("Challenge without realm or nonce")
+	}
+
+	var algorithms *msg.PasswordAlgorithmsAttr
+	alg := msg.AlgorithmMD5
+
+	// A nonce promising algorithms in a challenge without them means they
+	// were stripped on the way, RFC 8489 section 9.2.5
+	if nonce.(*msg.NonceAttr).Features()&msg.FeaturePasswordAlgorithms != 0 {
+		as, err := res.Attribute(msg.PasswordAlgorithms)
+		if err != nil {
+			return errors.New("Challenge is missing password algorithms")
+		}
+
+		algorithms = as.(*msg.PasswordAlgorithmsAttr)
+		if algorithms.Contains(msg.AlgorithmSHA256) {
+			alg = msg.AlgorithmSHA256
+		} else if !algorithms.Contains(msg.AlgorithmMD5) {
+			return errors.New("No supported password algorithm")
 		}
 	}
 
-	return &Connection{res, conn}, nil
+	this.authLock.Lock()
+	defer this.authLock.Unlock()
+
+	this.realm = r.(*msg.RealmAttr)
+	this.nonce = nonce.(*msg.NonceAttr)
+	this.algorithm = alg
+	this.algorithms = algorithms
+	return nil
 }
 
 func (this *Client) Bind() (*Connection, error) {
@@ -98,26 +485,18 @@ func (this *Client) Bind() (*Connection, error) {
 
 func ToIPPort(conn *Connection) (net.IP, int, error) {
 
-	xattr, err := conn.Res.Attribute(msg.XORMappedAddress)
+	addr, err := conn.Res.XORMappedAddress()
 	if err != nil {
 		return nil, -1, err
 	}
-
-	xor := xattr.(*msg.XORAddress)
-
-	return xor.IP(conn.Res.Header()), xor.Port(), nil
+	return addr.IP, addr.Port, nil
 }
 
 func (this *Client) Authenticate(res, oldReq *msg.Message) (*Connection, error) {
 
-	req := msg.NewRequest(msg.Request | msg.Binding)
-	req.CopyAttributes(oldReq)
-
-	r, _ := res.Attribute(msg.Realm)
-	this.realm = r.(*msg.RealmAttr)
-
-	nonce, _ := res.Attribute(msg.Nonce)
-	this.nonce = nonce.(*msg.NonceAttr)
+	if err := this.updateCredentials(res); err != nil {
+		return nil, err
+	}
 
-	return this.SendReqRes(req)
+	return this.SendReqRes(resend(oldReq))
 }
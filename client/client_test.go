@@ -0,0 +1,256 @@
+package client
+
+import (
+	"errors"
+	"github.com/ricochet2200/gun/msg"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// A UDP server answering each request with answer, nothing when it returns
+// nil.  Returns its address.
+func fakeServer(t *testing.T, answer func(req *msg.Message, from *net.UDPAddr) *msg.Message) string {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			req := &msg.Message{}
+			if req.UnmarshalBinary(buf[:n]) != nil {
+				continue
+			}
+			if res := answer(req, addr.(*net.UDPAddr)); res != nil {
+				pc.WriteTo(res.EncodeMessage(), addr)
+			}
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+const testRealm = "example.org"
+
+// The 401 a server sends to a request without credentials
+func challenge(req *msg.Message) *msg.Message {
+	res := msg.NewResponse(msg.Error, req)
+	e, _ := msg.NewErrorAttr(msg.Unauthorized, "")
+	r, _ := msg.NewRealm(testRealm)
+	res.AddAttribute(e)
+	res.AddAttribute(r)
+	res.AddAttribute(msg.NewNonceSigner([]byte("secret")).Nonce(net.IPv4(127, 0, 0, 1), 0))
+	return res
+}
+
+func signedRequest(req *msg.Message) bool {
+	_, err := req.Attribute(msg.MessageIntegrity)
+	return err == nil
+}
+
+func newTestClient(t *testing.T, server string) *Client {
+	c, err := NewUDPClient(server, "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func success(req *msg.Message) *msg.Message {
+	res := msg.NewResponse(msg.Success, req)
+	res.AddAttribute(msg.NewXORAddress(net.IPv4(192, 0, 2, 1), 1234, res.Header()))
+	return res
+}
+
+func signedSuccess(req *msg.Message) *msg.Message {
+	res := success(req)
+	key := msg.PasswordKey(msg.AlgorithmMD5, "user", testRealm, "pass")
+	res.AddAttribute(msg.NewIntegrityAttrKey(key, res))
+	return res
+}
+
+func TestSignedResponse(t *testing.T) {
+
+	server := fakeServer(t, func(req *msg.Message, from *net.UDPAddr) *msg.Message {
+		if !signedRequest(req) {
+			return challenge(req)
+		}
+		return signedSuccess(req)
+	})
+
+	if _, err := newTestClient(t, server).Bind(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Anyone could forge a response without integrity, RFC 5389 section 10.2.3
+func TestUnsignedResponseRejected(t *testing.T) {
+
+	server := fakeServer(t, func(req *msg.Message, from *net.UDPAddr) *msg.Message {
+		if !signedRequest(req) {
+			return challenge(req)
+		}
+		return success(req)
+	})
+
+	if _, err := newTestClient(t, server).Bind(); err != ErrNoIntegrity {
+		t.Fatalf("unsigned success to a signed request: %v", err)
+	}
+}
+
+// Errors about the credentials themselves cannot be signed
+func TestUnsignedErrorAllowed(t *testing.T) {
+
+	for _, code := range []msg.StunErrorCode{msg.BadRequest, msg.UnknownAttribute} {
+		code := code
+		server := fakeServer(t, func(req *msg.Message, from *net.UDPAddr) *msg.Message {
+			if !signedRequest(req) {
+				return challenge(req)
+			}
+			res := msg.NewResponse(msg.Error, req)
+			e, _ := msg.NewErrorAttr(code, "")
+			res.AddAttribute(e)
+			return res
+		})
+
+		_, err := newTestClient(t, server).Bind()
+		var se *msg.StunError
+		if !errors.As(err, &se) {
+			t.Fatalf("%d: %v", code, err)
+		}
+		if got, _ := se.Code(); got != code {
+			t.Errorf("got %d, want %d", got, code)
+		}
+	}
+
+	// Anything else must be signed
+	server := fakeServer(t, func(req *msg.Message, from *net.UDPAddr) *msg.Message {
+		if !signedRequest(req) {
+			return challenge(req)
+		}
+		res := msg.NewResponse(msg.Error, req)
+		e, _ := msg.NewErrorAttr(msg.ServerError, "")
+		res.AddAttribute(e)
+		return res
+	})
+	if _, err := newTestClient(t, server).Bind(); err != ErrNoIntegrity {
+		t.Fatalf("unsigned 500 to a signed request: %v", err)
+	}
+}
+
+// A server that keeps answering 438 must not be retried forever
+func TestStaleNonceRetriedOnce(t *testing.T) {
+
+	var lock sync.Mutex
+	requests := 0
+	server := fakeServer(t, func(req *msg.Message, from *net.UDPAddr) *msg.Message {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+
+		res := challenge(req)
+		if signedRequest(req) {
+			e, _ := msg.NewErrorAttr(msg.StaleNonce, "")
+			res.AddAttribute(e)
+		}
+		return res
+	})
+
+	_, err := newTestClient(t, server).Bind()
+	var se *msg.StunError
+	if !errors.As(err, &se) {
+		t.Fatalf("got %v", err)
+	}
+	if code, _ := se.Code(); code != msg.StaleNonce {
+		t.Errorf("got %d", code)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if requests != 3 {
+		t.Errorf("%d requests, want the first, the signed one and one retry", requests)
+	}
+}
+
+// A server redirecting to itself is a loop however its address is written
+func TestRedirectLoopSameAddress(t *testing.T) {
+
+	var lock sync.Mutex
+	requests := 0
+	var self *net.UDPAddr
+	server := fakeServer(t, func(req *msg.Message, from *net.UDPAddr) *msg.Message {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+
+		res := msg.NewResponse(msg.Error, req)
+		e, _ := msg.NewErrorAttr(msg.TryAlternative, "")
+		res.AddAttribute(e)
+		res.AddAttribute(msg.NewAlternateServer(self.IP, self.Port))
+		return res
+	})
+
+	lock.Lock()
+	self, _ = net.ResolveUDPAddr("udp", server)
+	lock.Unlock()
+	mapped := net.JoinHostPort("::ffff:"+self.IP.String(), strconv.Itoa(self.Port))
+
+	if _, err := newTestClient(t, mapped).Bind(); err == nil {
+		t.Fatal("redirect loop not detected")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if requests != 1 {
+		t.Errorf("%d requests, the loop should be caught at the first redirect", requests)
+	}
+}
+
+func TestSoftware(t *testing.T) {
+
+	var lock sync.Mutex
+	sent := ""
+	server := fakeServer(t, func(req *msg.Message, from *net.UDPAddr) *msg.Message {
+		lock.Lock()
+		sent, _ = req.Software()
+		lock.Unlock()
+
+		res := msg.NewResponse(msg.Success, req)
+		res.AddAttribute(msg.NewXORAddress(from.IP, from.Port, res.Header()))
+		sw, _ := msg.NewSoftware("test server")
+		res.AddAttribute(sw)
+		return res
+	})
+
+	c, err := NewUDPClient(server, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetSoftware("test client"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := c.Bind()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sw, ok := conn.ServerSoftware(); !ok || sw != "test server" {
+		t.Errorf("server SOFTWARE %+q, %v", sw, ok)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if sent != "test client" {
+		t.Errorf("client sent SOFTWARE %+q", sent)
+	}
+}
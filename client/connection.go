@@ -8,5 +8,39 @@ import (
 type Connection struct {
 	Res *msg.Message
 	Out net.Conn
+	// Set instead of Out for UDP clients, Addr is the server
+	Packet net.PacketConn
+	Addr   net.Addr
 }
 
+func (this *Connection) LocalAddr() net.Addr {
+	if this.Packet != nil {
+		return this.Packet.LocalAddr()
+	}
+	return this.Out.LocalAddr()
+}
+
+// The SOFTWARE the server described itself with, if it sent one
+func (this *Connection) ServerSoftware() (string, bool) {
+	if this.Res == nil {
+		return "", false
+	}
+	return this.Res.Software()
+}
+
+func (this *Connection) Close() error {
+	if this.Packet != nil {
+		return this.Packet.Close()
+	}
+	return this.Out.Close()
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
@@ -0,0 +1,283 @@
+package client
+
+import (
+	"errors"
+	"github.com/ricochet2200/gun/msg"
+	"log"
+	"net"
+)
+
+// How a NAT maps or filters, RFC 4787 terminology
+type NATBehavior int
+
+const (
+	BehaviorUnknown NATBehavior = iota
+	EndpointIndependent
+	AddressDependent
+	AddressAndPortDependent
+)
+
+func (this NATBehavior) String() string {
+	switch this {
+	case EndpointIndependent:
+		return "Endpoint Independent"
+	case AddressDependent:
+		return "Address Dependent"
+	case AddressAndPortDependent:
+		return "Address and Port Dependent"
+	}
+	return "Unknown"
+}
+
+type NATResult struct {
+	// False when the server sees the local address unchanged
+	NAT bool
+	// Reflexive address from the first test
+	Mapped      *net.UDPAddr
+	Mapping     NATBehavior
+	Filtering   NATBehavior
+	Hairpinning bool
+}
+
+var ErrNoDiscovery = errors.New("Server does not support NAT behavior discovery")
+
+// Runs the RFC 5780 mapping, filtering and hairpinning tests against the
+// client's server, which must be serving behavior discovery.  The tests always
+// run over UDP, whatever transport the client uses.  Servers that require
+// credentials are sent the client's, as by SendReqRes.
+// Tests that get no answer wait out the full retransmission schedule, so this
+// can take a while.
+func (this *Client) DiscoverNAT() (*NATResult, error) {
+
+	server, err := net.ResolveUDPAddr("udp", this.server)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	// Test I, plain binding to the primary address
+	res, err := this.discoveryBind(pc, server, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	mapped, err := udpAddr(res, msg.XORMappedAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	other, err := udpAddr(res, msg.OtherAddress)
+	if err != nil {
+		return nil, ErrNoDiscovery
+	}
+
+	result := &NATResult{Mapped: mapped}
+	result.NAT = !isLocal(mapped, pc.LocalAddr().(*net.UDPAddr).Port)
+
+	if result.Mapping, err = this.mappingBehavior(pc, server, other, mapped, result.NAT); err != nil {
+		return nil, err
+	}
+
+	if result.Filtering, err = this.filteringBehavior(server); err != nil {
+		return nil, err
+	}
+
+	if result.Hairpinning, err = this.hairpinning(pc, mapped); err != nil {
+		return nil, err
+	}
+
+	log.Println("NAT:", result.NAT, "Mapping:", result.Mapping, "Filtering:", result.Filtering)
+	return result, nil
+}
+
+// RFC 5780 section 4.3
+func (this *Client) mappingBehavior(pc net.PacketConn, server, other, mapped *net.UDPAddr, nat bool) (NATBehavior, error) {
+
+	if !nat {
+		return EndpointIndependent, nil
+	}
+
+	// Test II, alternate IP and primary port
+	res, err := this.discoveryBind(pc, &net.UDPAddr{IP: other.IP, Port: server.Port}, nil)
+	if err != nil {
+		return BehaviorUnknown, err
+	}
+
+	mapped2, err := udpAddr(res, msg.XORMappedAddress)
+	if err != nil {
+		return BehaviorUnknown, err
+	}
+
+	if sameAddr(mapped, mapped2) {
+		return EndpointIndependent, nil
+	}
+
+	// Test III, alternate IP and alternate port
+	res, err = this.discoveryBind(pc, other, nil)
+	if err != nil {
+		return BehaviorUnknown, err
+	}
+
+	mapped3, err := udpAddr(res, msg.XORMappedAddress)
+	if err != nil {
+		return BehaviorUnknown, err
+	}
+
+	if sameAddr(mapped2, mapped3) {
+		return AddressDependent, nil
+	}
+	return AddressAndPortDependent, nil
+}
+
+// RFC 5780 section 4.4.  The mapping tests let the alternate address through
+// the NAT's filter for the first socket, so this runs from a new one, whose
+// mapping has only sent to the primary address.
+func (this *Client) filteringBehavior(server *net.UDPAddr) (NATBehavior, error) {
+
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return BehaviorUnknown, err
+	}
+	defer pc.Close()
+
+	// Test I, creates the mapping
+	if _, err := this.discoveryBind(pc, server, nil); err != nil {
+		return BehaviorUnknown, err
+	}
+
+	// Test II, ask for the answer from the alternate IP and port
+	_, err = this.discoveryBind(pc, server, msg.NewChangeRequest(true, true))
+	if err == nil {
+		return EndpointIndependent, nil
+	} else if err != ErrTimeout {
+		return BehaviorUnknown, err
+	}
+
+	// Test III, ask for the answer from the alternate port only
+	_, err = this.discoveryBind(pc, server, msg.NewChangeRequest(false, true))
+	if err == nil {
+		return AddressDependent, nil
+	} else if err != ErrTimeout {
+		return BehaviorUnknown, err
+	}
+	return AddressAndPortDependent, nil
+}
+
+// RFC 5780 section 4.5, a request sent from a second socket to the mapped
+// address of the first should come back around to the first
+func (this *Client) hairpinning(pc net.PacketConn, mapped *net.UDPAddr) (bool, error) {
+
+	pc2, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return false, err
+	}
+	defer pc2.Close()
+
+	req := msg.NewRequest(msg.Request | msg.Binding)
+	send := func(b []byte) error {
+		_, err := pc2.WriteTo(b, mapped)
+		return err
+	}
+
+	_, err = this.retransmit(mapped.String(), req, send, readResponse(pc, req))
+	if err == ErrTimeout {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Sends a Binding request from pc to to, answering challenges for credentials
+// with the client's as SendReqRes does
+func (this *Client) discoveryBind(pc net.PacketConn, to *net.UDPAddr, change *msg.ChangeRequestAttr) (*msg.Message, error) {
+
+	send := func(b []byte) error {
+		_, err := pc.WriteTo(b, to)
+		return err
+	}
+
+	var seen challenges
+	for {
+		req := msg.NewRequest(msg.Request | msg.Binding)
+		if change != nil {
+			req.AddAttribute(change)
+		}
+		this.sign(req)
+
+		res, err := this.retransmit(to.String(), req, send, readResponse(pc, req))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := this.verify(res, req); err != nil {
+			return nil, err
+		}
+
+		retry, err := this.challenged(res, req, &seen)
+		if err != nil {
+			return nil, err
+		} else if !retry {
+			if err := responseError(res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		}
+
+		if err := this.updateCredentials(res); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Reads an address attribute of type t from res
+func udpAddr(res *msg.Message, t msg.TLVType) (*net.UDPAddr, error) {
+
+	a, err := res.Attribute(t)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := a.(type) {
+	case *msg.XORAddress:
+		ip, err := v.IP(res.Header())
+		if err != nil {
+			return nil, err
+		}
+		return &net.UDPAddr{IP: ip, Port: v.Port()}, nil
+	case *msg.OtherAddressAttr:
+		ip, err := v.IP()
+		if err != nil {
+			return nil, err
+		}
+		return &net.UDPAddr{IP: ip, Port: v.Port()}, nil
+	}
+	return nil, errors.New("Not an address attribute")
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// True if addr is one of this host's addresses on port
+func isLocal(addr *net.UDPAddr, port int) bool {
+
+	if addr.Port != port {
+		return false
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
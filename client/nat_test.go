@@ -0,0 +1,86 @@
+package client
+
+import (
+	"github.com/ricochet2200/gun/msg"
+	"net"
+	"sync"
+	"testing"
+)
+
+// The filtering tests must not reuse the socket the mapping tests opened the
+// NAT for, RFC 5780 section 4.4
+func TestFilteringFreshSocket(t *testing.T) {
+
+	var lock sync.Mutex
+	var from []*net.UDPAddr
+	var changes []bool
+
+	server := fakeServer(t, func(req *msg.Message, addr *net.UDPAddr) *msg.Message {
+		lock.Lock()
+		from = append(from, addr)
+		changes = append(changes, req.Has(msg.ChangeRequest))
+		lock.Unlock()
+		return success(req)
+	})
+
+	c := newTestClient(t, server)
+	to, _ := net.ResolveUDPAddr("udp", server)
+
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	c.discoveryBind(pc, to, nil)
+
+	behavior, err := c.filteringBehavior(to)
+	if err != nil || behavior != EndpointIndependent {
+		t.Fatalf("got %v, %v", behavior, err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(from) != 3 || changes[1] || !changes[2] {
+		t.Fatalf("requests %v with CHANGE-REQUEST %v", from, changes)
+	}
+	mapping := pc.LocalAddr().(*net.UDPAddr).Port
+	if from[1].Port == mapping || from[2].Port != from[1].Port {
+		t.Errorf("filtering tests sent from ports %d and %d, mapping tests from %d",
+			from[1].Port, from[2].Port, mapping)
+	}
+}
+
+// Servers with an Authenticator challenge discovery requests like any other
+func TestDiscoveryCredentials(t *testing.T) {
+
+	var lock sync.Mutex
+	changed := false
+	server := fakeServer(t, func(req *msg.Message, addr *net.UDPAddr) *msg.Message {
+		if !signedRequest(req) {
+			return challenge(req)
+		}
+		lock.Lock()
+		changed = req.Has(msg.ChangeRequest)
+		lock.Unlock()
+		return signedSuccess(req)
+	})
+
+	c := newTestClient(t, server)
+	to, _ := net.ResolveUDPAddr("udp", server)
+
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	if _, err := c.discoveryBind(pc, to, msg.NewChangeRequest(false, true)); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !changed {
+		t.Error("CHANGE-REQUEST lost when the request was signed")
+	}
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ricochet2200/gun/msg"
+	"net"
+	"time"
+)
+
+// Retransmission parameters from RFC 5389 section 7.2.1
+const (
+	DefaultRTO = 500 * time.Millisecond
+	Rc         = 7
+	Rm         = 16
+)
+
+// Bounds on the computed RTO.  RFC 5389 asks that it not be rounded up to a
+// second the way RFC 2988 does, so the floor is well below that.
+const MinRTO = 100 * time.Millisecond
+const MaxRTO = 60 * time.Second
+
+// How long a measured RTO is trusted before falling back to DefaultRTO
+const RTOCacheTime = 10 * time.Minute
+
+// Largest datagram the UDP client will read
+const MaxPacketSize = 65535
+
+var ErrTimeout = errors.New("STUN transaction timed out")
+
+// Smoothed RTT and RTO for one server, calculated as in RFC 2988
+type rtoEstimator struct {
+	srtt    time.Duration
+	rttvar  time.Duration
+	rto     time.Duration
+	updated time.Time
+}
+
+func (this *rtoEstimator) stale() bool {
+	return this.rto == 0 || time.Since(this.updated) > RTOCacheTime
+}
+
+func (this *rtoEstimator) RTO() time.Duration {
+	if this.stale() {
+		return DefaultRTO
+	}
+	return this.rto
+}
+
+func (this *rtoEstimator) Sample(rtt time.Duration) {
+
+	if this.stale() {
+		this.srtt = rtt
+		this.rttvar = rtt / 2
+	} else {
+		delta := this.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		this.rttvar = (3*this.rttvar + delta) / 4
+		this.srtt = (7*this.srtt + rtt) / 8
+	}
+
+	this.rto = this.srtt + 4*this.rttvar
+	if this.rto < MinRTO {
+		this.rto = MinRTO
+	} else if this.rto > MaxRTO {
+		this.rto = MaxRTO
+	}
+	this.updated = time.Now()
+}
+
+func (this *Client) estimator(server string) *rtoEstimator {
+	this.rtoLock.Lock()
+	defer this.rtoLock.Unlock()
+
+	e, ok := this.rto[server]
+	if !ok {
+		e = &rtoEstimator{}
+		this.rto[server] = e
+	}
+	return e
+}
+
+// RTO currently used for requests to server
+func (this *Client) RTO(server string) time.Duration {
+	e := this.estimator(server)
+
+	this.rtoLock.Lock()
+	defer this.rtoLock.Unlock()
+	return e.RTO()
+}
+
+// Sends req with send until recv returns a response, following the RFC 5389
+// schedule: Rc transmissions with the wait doubling each time, then Rm times
+// the initial RTO after the last one.  recv should return a net.Error that
+// times out once the deadline passes.
+func (this *Client) retransmit(server string, req *msg.Message, send func([]byte) error,
+	recv func(time.Time) (*msg.Message, error)) (*msg.Message, error) {
+
+	e := this.estimator(server)
+	this.rtoLock.Lock()
+	rto := e.RTO()
+	this.rtoLock.Unlock()
+
+	data := req.EncodeMessage()
+	start := time.Now()
+	wait := rto
+	for i := 1; i <= Rc; i++ {
+		if err := send(data); err != nil {
+			return nil, err
+		}
+
+		if i == Rc {
+			wait = Rm * rto
+		}
+
+		res, err := recv(time.Now().Add(wait))
+		if err == nil {
+			// Karn's algorithm, retransmitted requests give ambiguous samples
+			if i == 1 {
+				this.rtoLock.Lock()
+				e.Sample(time.Since(start))
+				this.rtoLock.Unlock()
+			}
+			return res, nil
+		}
+
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return nil, err
+		}
+		wait *= 2
+	}
+
+	return nil, ErrTimeout
+}
+
+// Returns a recv function for retransmit that reads datagrams from conn until
+// one carries the transaction id of req.  Anything else is dropped.
+func readResponse(conn net.PacketConn, req *msg.Message) func(time.Time) (*msg.Message, error) {
+
+	id := req.Header().TransactionId()
+	buf := make([]byte, MaxPacketSize)
+	return func(deadline time.Time) (*msg.Message, error) {
+		conn.SetReadDeadline(deadline)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return nil, err
+			}
+
+			res, err := msg.DecodeMessage(bytes.NewReader(buf[:n]))
+			if err != nil {
+				continue
+			}
+
+			if bytes.Equal(res.Header().TransactionId(), id) {
+				return res, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"errors"
+	"github.com/ricochet2200/gun/msg"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func newRTOClient() *Client {
+	return &Client{rto: map[string]*rtoEstimator{}}
+}
+
+func near(a, b time.Duration) bool {
+	d := a - b
+	return d > -50*time.Millisecond && d < 50*time.Millisecond
+}
+
+// RFC 5389 section 7.2.1, with the default RTO of 500 ms requests are sent at
+// 0, 500, 1500, 3500, 7500, 15500 and 31500 ms and fail at 39500 ms
+func TestRetransmitSchedule(t *testing.T) {
+
+	sends := 0
+	var waits []time.Duration
+	send := func([]byte) error { sends++; return nil }
+	recv := func(deadline time.Time) (*msg.Message, error) {
+		waits = append(waits, time.Until(deadline))
+		return nil, timeoutError{}
+	}
+
+	c := newRTOClient()
+	_, err := c.retransmit("server", msg.NewRequest(msg.Binding|msg.Request), send, recv)
+	if err != ErrTimeout {
+		t.Fatalf("got %v, want ErrTimeout", err)
+	}
+	if sends != Rc {
+		t.Fatalf("%d transmissions, want %d", sends, Rc)
+	}
+
+	want := []time.Duration{500, 1000, 2000, 4000, 8000, 16000, Rm * 500}
+	total := time.Duration(0)
+	for i, w := range want {
+		w *= time.Millisecond
+		if !near(waits[i], w) {
+			t.Errorf("wait %d is %v, want %v", i, waits[i], w)
+		}
+		total += waits[i]
+	}
+	if !near(total, 39500*time.Millisecond) {
+		t.Errorf("gave up after %v, want 39.5s", total)
+	}
+}
+
+func TestRetransmitError(t *testing.T) {
+
+	sends := 0
+	fail := errors.New("Connection refused")
+	send := func([]byte) error { sends++; return nil }
+	recv := func(time.Time) (*msg.Message, error) { return nil, fail }
+
+	c := newRTOClient()
+	if _, err := c.retransmit("server", msg.NewRequest(msg.Binding|msg.Request), send, recv); err != fail {
+		t.Fatalf("got %v", err)
+	}
+	if sends != 1 {
+		t.Errorf("%d transmissions after an error that is not a timeout", sends)
+	}
+}
+
+// Karn's algorithm, only answers to the first transmission are measured
+func TestRetransmitKarn(t *testing.T) {
+
+	for _, answered := range []int{1, 2} {
+		req := msg.NewRequest(msg.Binding | msg.Request)
+		sends := 0
+		send := func([]byte) error { sends++; return nil }
+		recv := func(time.Time) (*msg.Message, error) {
+			if sends < answered {
+				return nil, timeoutError{}
+			}
+			return msg.NewResponse(msg.Success, req), nil
+		}
+
+		c := newRTOClient()
+		if _, err := c.retransmit("server", req, send, recv); err != nil {
+			t.Fatal(err)
+		}
+
+		sampled := c.RTO("server") != DefaultRTO
+		if sampled != (answered == 1) {
+			t.Errorf("answered on transmission %d, sampled %v", answered, sampled)
+		}
+	}
+}
+
+func TestRTOEstimator(t *testing.T) {
+
+	e := &rtoEstimator{}
+	if e.RTO() != DefaultRTO {
+		t.Fatalf("initial RTO %v", e.RTO())
+	}
+
+	// RFC 2988 section 2.2, then 2.3
+	e.Sample(200 * time.Millisecond)
+	if e.RTO() != 600*time.Millisecond {
+		t.Errorf("RTO %v after the first sample, want 600ms", e.RTO())
+	}
+	e.Sample(100 * time.Millisecond)
+	if e.RTO() != 587500*time.Microsecond {
+		t.Errorf("RTO %v after the second sample, want 587.5ms", e.RTO())
+	}
+
+	for i := 0; i < 50; i++ {
+		e.Sample(time.Millisecond)
+	}
+	if e.RTO() != MinRTO {
+		t.Errorf("RTO %v, want MinRTO", e.RTO())
+	}
+
+	e.Sample(time.Hour)
+	if e.RTO() != MaxRTO {
+		t.Errorf("RTO %v, want MaxRTO", e.RTO())
+	}
+
+	e.updated = time.Now().Add(-RTOCacheTime - time.Second)
+	if e.RTO() != DefaultRTO {
+		t.Errorf("stale RTO %v, want DefaultRTO", e.RTO())
+	}
+}
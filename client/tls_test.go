@@ -0,0 +1,112 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/ricochet2200/gun/msg"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// A self-signed certificate for localhost alone, not its address, and a pool
+// trusting it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// A TLS server on 127.0.0.1 answering the first request on each connection
+// with answer.  Returns its address.
+func fakeTLSServer(t *testing.T, cert tls.Certificate, answer func(req *msg.Message) *msg.Message) *net.TCPAddr {
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				if req, err := msg.DecodeMessage(conn); err == nil {
+					conn.Write(answer(req).EncodeMessage())
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// The server redirected to is known only by its address, so its certificate
+// is checked against the name of the first
+func TestTLSRedirect(t *testing.T) {
+
+	cert, pool := testCertificate(t)
+	alt := fakeTLSServer(t, cert, success)
+	first := fakeTLSServer(t, cert, func(req *msg.Message) *msg.Message {
+		res := msg.NewResponse(msg.Error, req)
+		e, _ := msg.NewErrorAttr(msg.TryAlternative, "")
+		res.AddAttribute(e)
+		res.AddAttribute(msg.NewAlternateServer(alt.IP, alt.Port))
+		return res
+	})
+
+	server := net.JoinHostPort("localhost", strconv.Itoa(first.Port))
+	c, err := NewTLSClient(server, "user", "pass", &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := c.Bind()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if ip, _, err := ToIPPort(conn); err != nil || !ip.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("mapped %v, %v, want the alternate server's answer", ip, err)
+	}
+}
@@ -0,0 +1,636 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ricochet2200/gun/msg"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Permissions and channel bindings last 5 and 10 minutes on the server, RFC
+// 5766 sections 8 and 11.  They are refreshed a minute early, as is the
+// allocation itself.
+const PermissionLifetime = 5 * time.Minute
+const ChannelLifetime = 10 * time.Minute
+const RefreshMargin = time.Minute
+
+// How often an allocation checks whether anything needs refreshing
+const RefreshInterval = 15 * time.Second
+
+// Packets from peers queued before ReadFrom drops new ones
+const RelayQueueSize = 64
+
+var ErrAllocationClosed = errors.New("TURN allocation closed")
+
+// A TURN allocation on the client's server, usable as an ordinary
+// net.PacketConn.  Writes are relayed to the peer through the server, which
+// needs a permission for the peer first.  Permissions are created on the
+// first write to a peer and refreshed while the allocation is open.
+type Allocation struct {
+	client  *Client
+	conn    net.PacketConn
+	server  *net.UDPAddr
+	relayed *net.UDPAddr
+
+	lock            sync.Mutex
+	expires         time.Time
+	lifetime        time.Duration
+	pending         map[string]chan *msg.Message
+	permissions     map[string]time.Time // peer IP to expiry
+	permitting      map[string]*permitting
+	channels        map[string]uint16    // peer address to channel
+	peers           map[uint16]*net.UDPAddr
+	channelExpires  map[uint16]time.Time
+	nextChannel     uint16
+	readDeadline    time.Time
+	writeDeadline   time.Time
+	deadlineChanged chan struct{}
+
+	data      chan relayedPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ net.PacketConn = (*Allocation)(nil)
+
+type relayedPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// A CreatePermission in progress for one peer, which every write to the peer
+// waits for rather than sending its own
+type permitting struct {
+	done chan struct{}
+	err  error
+}
+
+// Allocates a UDP relay on the client's server.  Credentials are handled the
+// same way as SendReqRes, so a client that has already authenticated does not
+// need to be challenged again.
+func (this *Client) Allocate() (*Allocation, error) {
+
+	server, err := net.ResolveUDPAddr("udp", this.server)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Allocation{
+		client:          this,
+		conn:            pc,
+		server:          server,
+		pending:         map[string]chan *msg.Message{},
+		permissions:     map[string]time.Time{},
+		permitting:      map[string]*permitting{},
+		channels:        map[string]uint16{},
+		peers:           map[uint16]*net.UDPAddr{},
+		channelExpires:  map[uint16]time.Time{},
+		nextChannel:     msg.MinChannel,
+		deadlineChanged: make(chan struct{}),
+		data:            make(chan relayedPacket, RelayQueueSize),
+		closed:          make(chan struct{}),
+	}
+	go a.read()
+
+	res, err := a.request(func() *msg.Message {
+		req := msg.NewRequest(msg.Allocate | msg.Request)
+		req.AddAttribute(msg.NewRequestedTransport(msg.TransportUDP))
+		return req
+	})
+	if err != nil {
+		a.shutdown()
+		return nil, err
+	}
+
+	relayed, err := udpAddr(res, msg.XORRelayedAddress)
+	if err != nil {
+		a.shutdown()
+		return nil, err
+	}
+	a.relayed = relayed
+	a.setLifetime(res)
+
+	go a.refresh()
+	return a, nil
+}
+
+// Sends the request build returns and waits for a success response.  The
+// request is rebuilt, so it gets a new transaction id, whenever the server
+// challenges for credentials.
+func (this *Allocation) request(build func() *msg.Message) (*msg.Message, error) {
+
+	var seen challenges
+	for {
+		req := build()
+		this.client.sign(req)
+
+		res, err := this.transact(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := this.client.verify(res, req); err != nil {
+			return nil, err
+		}
+
+		retry, err := this.client.challenged(res, req, &seen)
+		if err != nil {
+			return nil, err
+		} else if !retry {
+			if err := responseError(res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		}
+
+		if err := this.client.updateCredentials(res); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (this *Allocation) transact(req *msg.Message) (*msg.Message, error) {
+
+	id := string(req.Header().TransactionId())
+	ch := make(chan *msg.Message, 1)
+
+	this.lock.Lock()
+	this.pending[id] = ch
+	this.lock.Unlock()
+
+	defer func() {
+		this.lock.Lock()
+		delete(this.pending, id)
+		this.lock.Unlock()
+	}()
+
+	send := func(b []byte) error {
+		_, err := this.conn.WriteTo(b, this.server)
+		return err
+	}
+
+	recv := func(deadline time.Time) (*msg.Message, error) {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+
+		select {
+		case res := <-ch:
+			return res, nil
+		case <-t.C:
+			return nil, os.ErrDeadlineExceeded
+		case <-this.closed:
+			return nil, ErrAllocationClosed
+		}
+	}
+
+	return this.client.retransmit(this.server.String(), req, send, recv)
+}
+
+// Reads everything the server sends, handing responses to their transactions
+// and relayed data to ReadFrom.  Anything from another address is dropped, as
+// anyone could send data claiming to come from a peer.
+func (this *Allocation) read() {
+
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, from, err := this.conn.ReadFrom(buf)
+		if err != nil {
+			this.shutdown()
+			return
+		}
+
+		if addr, ok := from.(*net.UDPAddr); !ok || !sameAddr(addr, this.server) {
+			continue
+		}
+
+		if msg.IsChannelData(buf[:n]) {
+			cd, err := msg.DecodeChannelData(buf[:n])
+			if err != nil {
+				continue
+			}
+
+			this.lock.Lock()
+			peer := this.peers[cd.Channel]
+			this.lock.Unlock()
+
+			if peer != nil {
+				this.deliver(cd.Data, peer)
+			}
+			continue
+		}
+
+		m, err := msg.DecodeMessage(bytes.NewReader(buf[:n]))
+		if err != nil {
+			continue
+		}
+
+		if m.Type() == msg.Data|msg.Indication {
+			peer, err := udpAddr(m, msg.XORPeerAddress)
+			d, dErr := m.Attribute(msg.DataAttribute)
+			if err == nil && dErr == nil {
+				this.deliver(d.Value(), peer)
+			}
+			continue
+		}
+
+		this.lock.Lock()
+		ch, ok := this.pending[string(m.Header().TransactionId())]
+		this.lock.Unlock()
+
+		if ok {
+			select {
+			case ch <- m:
+			default:
+			}
+		}
+	}
+}
+
+func (this *Allocation) deliver(data []byte, from *net.UDPAddr) {
+
+	p := relayedPacket{make([]byte, len(data)), from}
+	copy(p.data, data)
+
+	// Like any UDP socket, drop what the reader is not keeping up with
+	select {
+	case this.data <- p:
+	default:
+	}
+}
+
+func (this *Allocation) setLifetime(res *msg.Message) {
+
+	d := 10 * time.Minute
+	if l, err := res.Attribute(msg.Lifetime); err == nil {
+		d = l.(*msg.LifetimeAttr).Lifetime()
+	}
+
+	this.lock.Lock()
+	this.lifetime = d
+	this.expires = time.Now().Add(d)
+	this.lock.Unlock()
+}
+
+// Keeps the allocation, its permissions and its channels alive until Close
+func (this *Allocation) refresh() {
+
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if !this.refreshDue() {
+			return
+		}
+	}
+}
+
+// Refreshes whatever expires within RefreshMargin.  Returns false if the
+// allocation itself could not be refreshed and has been shut down.  Failed
+// permissions and channels are logged and lapse, so the next write to their
+// peer creates them again.
+func (this *Allocation) refreshDue() bool {
+
+	soon := time.Now().Add(RefreshMargin)
+
+	this.lock.Lock()
+	refresh := this.expires.Before(soon)
+	lifetime := this.lifetime
+	peers := []net.IP{}
+	for ip, t := range this.permissions {
+		if t.Before(soon) {
+			peers = append(peers, net.ParseIP(ip))
+		}
+	}
+	channels := map[uint16]*net.UDPAddr{}
+	for n, t := range this.channelExpires {
+		if t.Before(soon) {
+			channels[n] = this.peers[n]
+		}
+	}
+	this.lock.Unlock()
+
+	if refresh {
+		res, err := this.request(func() *msg.Message {
+			req := msg.NewRequest(msg.Refresh | msg.Request)
+			req.AddAttribute(msg.NewLifetime(lifetime))
+			return req
+		})
+		if err != nil {
+			log.Println("Refreshing allocation failed:", err)
+			this.shutdown()
+			return false
+		}
+		this.setLifetime(res)
+	}
+
+	if len(peers) > 0 {
+		if err := this.createPermission(peers...); err != nil {
+			log.Println("Refreshing permissions failed:", err)
+		}
+	}
+
+	for n, peer := range channels {
+		if err := this.channelBind(n, peer); err != nil {
+			log.Println("Refreshing channel", n, "failed:", err)
+		}
+	}
+	return true
+}
+
+func (this *Allocation) createPermission(ips ...net.IP) error {
+
+	_, err := this.request(func() *msg.Message {
+		req := msg.NewRequest(msg.CreatePermission | msg.Request)
+		for _, ip := range ips {
+			req.AddDupAttribute(msg.NewXORPeerAddress(ip, 0, req.Header()))
+		}
+		return req
+	})
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	for _, ip := range ips {
+		this.permissions[ip.String()] = time.Now().Add(PermissionLifetime)
+	}
+	this.lock.Unlock()
+	return nil
+}
+
+func (this *Allocation) channelBind(number uint16, peer *net.UDPAddr) error {
+
+	_, err := this.request(func() *msg.Message {
+		req := msg.NewRequest(msg.ChannelBind | msg.Request)
+		req.AddAttribute(msg.NewChannelNumber(number))
+		req.AddAttribute(msg.NewXORPeerAddress(peer.IP, peer.Port, req.Header()))
+		return req
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	this.lock.Lock()
+	this.channels[peer.String()] = number
+	this.peers[number] = peer
+	this.channelExpires[number] = now.Add(ChannelLifetime)
+	this.permissions[peer.IP.String()] = now.Add(PermissionLifetime)
+	this.lock.Unlock()
+	return nil
+}
+
+// Binds a channel to peer so traffic to and from it uses ChannelData, which
+// has 4 bytes of overhead instead of 36.  Returns the existing channel if
+// there is one.
+func (this *Allocation) BindChannel(peer *net.UDPAddr) (uint16, error) {
+
+	this.lock.Lock()
+	number, ok := this.channels[peer.String()]
+	if !ok {
+		if this.nextChannel > msg.MaxChannel {
+			this.lock.Unlock()
+			return 0, errors.New("No channels left")
+		}
+		number = this.nextChannel
+		this.nextChannel++
+	}
+	this.lock.Unlock()
+
+	if ok {
+		return number, nil
+	}
+	return number, this.channelBind(number, peer)
+}
+
+// Creates a permission for peer on the server, which is otherwise done on
+// the first write to it.  Peers cannot send anything through the relay
+// without one.
+func (this *Allocation) Permit(peer net.IP) error {
+	return this.createPermission(peer)
+}
+
+func (this *Allocation) ReadFrom(p []byte) (int, net.Addr, error) {
+
+	for {
+		this.lock.Lock()
+		deadline := this.readDeadline
+		changed := this.deadlineChanged
+		this.lock.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case pkt := <-this.data:
+			if timer != nil {
+				timer.Stop()
+			}
+			return copy(p, pkt.data), pkt.from, nil
+		case <-this.closed:
+			if timer != nil {
+				timer.Stop()
+			}
+			return 0, nil, ErrAllocationClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-changed:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+func (this *Allocation) WriteTo(p []byte, addr net.Addr) (int, error) {
+
+	select {
+	case <-this.closed:
+		return 0, ErrAllocationClosed
+	default:
+	}
+
+	peer, ok := addr.(*net.UDPAddr)
+	if !ok {
+		var err error
+		if peer, err = net.ResolveUDPAddr("udp", addr.String()); err != nil {
+			return 0, err
+		}
+	}
+
+	this.lock.Lock()
+	deadline := this.writeDeadline
+	number, bound := this.channels[peer.String()]
+	bound = bound && time.Now().Before(this.channelExpires[number])
+	this.lock.Unlock()
+
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	if err := this.permit(peer.IP); err != nil {
+		return 0, err
+	}
+
+	if bound {
+		cd := &msg.ChannelData{Channel: number, Data: p}
+		if _, err := this.conn.WriteTo(cd.Encode(), this.server); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	ind := msg.NewRequest(msg.Send | msg.Indication)
+	ind.AddAttribute(msg.NewXORPeerAddress(peer.IP, peer.Port, ind.Header()))
+	ind.AddAttribute(msg.NewDataAttr(p))
+	if _, err := this.conn.WriteTo(ind.EncodeMessage(), this.server); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Waits until the server has a permission for ip, or the write deadline.
+// Permissions that have lapsed, because refreshing them failed, are created
+// again.  Concurrent writes to a new peer share one CreatePermission, which
+// carries on after a deadline so later writes can use it.
+func (this *Allocation) permit(ip net.IP) error {
+
+	key := ip.String()
+
+	this.lock.Lock()
+	if expires, ok := this.permissions[key]; ok && time.Now().Before(expires) {
+		this.lock.Unlock()
+		return nil
+	}
+
+	p, ok := this.permitting[key]
+	if !ok {
+		p = &permitting{done: make(chan struct{})}
+		this.permitting[key] = p
+		go func() {
+			p.err = this.createPermission(ip)
+
+			this.lock.Lock()
+			delete(this.permitting, key)
+			this.lock.Unlock()
+			close(p.done)
+		}()
+	}
+	this.lock.Unlock()
+
+	for {
+		this.lock.Lock()
+		deadline := this.writeDeadline
+		changed := this.deadlineChanged
+		this.lock.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		var err error
+		waiting := false
+		select {
+		case <-p.done:
+			err = p.err
+		case <-this.closed:
+			err = ErrAllocationClosed
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-changed:
+			waiting = true
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if !waiting {
+			return err
+		}
+	}
+}
+
+// Deletes the allocation on the server and closes the socket.  The server is
+// not waited on, if the Refresh is lost the allocation simply times out.
+func (this *Allocation) Close() error {
+
+	select {
+	case <-this.closed:
+		return ErrAllocationClosed
+	default:
+	}
+
+	req := msg.NewRequest(msg.Refresh | msg.Request)
+	req.AddAttribute(msg.NewLifetime(0))
+	this.client.sign(req)
+	this.conn.WriteTo(req.EncodeMessage(), this.server)
+
+	this.shutdown()
+	return nil
+}
+
+func (this *Allocation) shutdown() {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+		this.conn.Close()
+	})
+}
+
+// The relayed address peers send to
+func (this *Allocation) LocalAddr() net.Addr {
+	return this.relayed
+}
+
+func (this *Allocation) SetDeadline(t time.Time) error {
+	this.SetReadDeadline(t)
+	return this.SetWriteDeadline(t)
+}
+
+func (this *Allocation) SetReadDeadline(t time.Time) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.readDeadline = t
+	close(this.deadlineChanged)
+	this.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// Writes only block waiting for the permission the first write to a peer
+// creates, which is what the deadline interrupts
+func (this *Allocation) SetWriteDeadline(t time.Time) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.writeDeadline = t
+	close(this.deadlineChanged)
+	this.deadlineChanged = make(chan struct{})
+	return nil
+}
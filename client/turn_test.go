@@ -0,0 +1,210 @@
+package client
+
+import (
+	"errors"
+	"github.com/ricochet2200/gun/msg"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPeer = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 7000}
+
+// A TURN server that allocates, answers CreatePermission with permit and
+// echoes Send indications back as Data indications.  permit answers nothing
+// when it returns false.
+func fakeTURN(t *testing.T, permit func() bool) string {
+	return fakeServer(t, func(req *msg.Message, from *net.UDPAddr) *msg.Message {
+		switch req.Type() {
+		case msg.Allocate | msg.Request:
+			res := msg.NewResponse(msg.Success, req)
+			res.AddAttribute(msg.NewXORRelayedAddress(net.IPv4(192, 0, 2, 2), 5000, res.Header()))
+			return res
+
+		case msg.CreatePermission | msg.Request:
+			if !permit() {
+				return nil
+			}
+			return msg.NewResponse(msg.Success, req)
+
+		case msg.Send | msg.Indication:
+			d, err := req.Attribute(msg.DataAttribute)
+			if err != nil {
+				return nil
+			}
+			ind := msg.NewRequest(msg.Data | msg.Indication)
+			ind.AddAttribute(msg.NewXORPeerAddress(testPeer.IP, testPeer.Port, ind.Header()))
+			ind.AddAttribute(msg.NewDataAttr(d.Value()))
+			return ind
+		}
+		return nil
+	})
+}
+
+func allocate(t *testing.T, server string) *Allocation {
+	a, err := newTestClient(t, server).Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+// Only the TURN server may relay data, RFC 5766 section 10.4
+func TestRelayedDataFromServerOnly(t *testing.T) {
+
+	a := allocate(t, fakeTURN(t, func() bool { return true }))
+
+	spoofer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofer.Close()
+
+	ind := msg.NewRequest(msg.Data | msg.Indication)
+	ind.AddAttribute(msg.NewXORPeerAddress(testPeer.IP, testPeer.Port, ind.Header()))
+	ind.AddAttribute(msg.NewDataAttr([]byte("spoofed")))
+	cd := &msg.ChannelData{Channel: msg.MinChannel, Data: []byte("spoofed")}
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.conn.LocalAddr().(*net.UDPAddr).Port}
+	spoofer.WriteTo(ind.EncodeMessage(), local)
+	spoofer.WriteTo(cd.Encode(), local)
+
+	if _, err := a.WriteTo([]byte("echo"), testPeer); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 100)
+	a.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := a.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "echo" || !sameAddr(from.(*net.UDPAddr), testPeer) {
+		t.Fatalf("read %q from %v", buf[:n], from)
+	}
+}
+
+// Writes racing to a new peer must share one CreatePermission
+func TestPermissionCreatedOnce(t *testing.T) {
+
+	var lock sync.Mutex
+	permissions := 0
+	a := allocate(t, fakeTURN(t, func() bool {
+		lock.Lock()
+		permissions++
+		lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		return true
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := a.WriteTo([]byte("hi"), testPeer); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if permissions != 1 {
+		t.Fatalf("%d CreatePermission requests", permissions)
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+
+	a := allocate(t, fakeTURN(t, func() bool { return false }))
+	a.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+
+	start := time.Now()
+	_, err := a.WriteTo([]byte("hi"), testPeer)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("write blocked for %v", d)
+	}
+
+	if _, err := a.WriteTo([]byte("hi"), testPeer); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write after the deadline: %v", err)
+	}
+}
+
+// Counts the CreatePermission requests a fakeTURN answers
+func countPermissions(t *testing.T) (*Allocation, func() int) {
+
+	var lock sync.Mutex
+	permissions := 0
+	a := allocate(t, fakeTURN(t, func() bool {
+		lock.Lock()
+		permissions++
+		lock.Unlock()
+		return true
+	}))
+
+	return a, func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return permissions
+	}
+}
+
+func permissionExpiry(a *Allocation) time.Time {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.permissions[testPeer.IP.String()]
+}
+
+// Permissions refreshed before they lapse, RFC 5766 section 8
+func TestPermissionRefreshed(t *testing.T) {
+
+	a, permissions := countPermissions(t)
+	if _, err := a.WriteTo([]byte("hi"), testPeer); err != nil {
+		t.Fatal(err)
+	}
+
+	a.lock.Lock()
+	a.permissions[testPeer.IP.String()] = time.Now().Add(RefreshMargin / 2)
+	a.lock.Unlock()
+
+	if !a.refreshDue() {
+		t.Fatal("allocation shut down")
+	}
+	if n := permissions(); n != 2 {
+		t.Fatalf("%d CreatePermission requests, want the first and a refresh", n)
+	}
+	if time.Until(permissionExpiry(a)) < PermissionLifetime-time.Minute {
+		t.Errorf("permission expires at %v after the refresh", permissionExpiry(a))
+	}
+}
+
+// A permission that lapsed, because refreshing it failed, is created again
+// by the next write instead of the relay silently dropping it
+func TestPermissionExpiry(t *testing.T) {
+
+	a, permissions := countPermissions(t)
+	if _, err := a.WriteTo([]byte("hi"), testPeer); err != nil {
+		t.Fatal(err)
+	}
+
+	a.lock.Lock()
+	a.permissions[testPeer.IP.String()] = time.Now().Add(-time.Second)
+	a.lock.Unlock()
+
+	if _, err := a.WriteTo([]byte("hi"), testPeer); err != nil {
+		t.Fatal(err)
+	}
+	if n := permissions(); n != 2 {
+		t.Fatalf("%d CreatePermission requests, want one before and one after the expiry", n)
+	}
+	if !time.Now().Before(permissionExpiry(a)) {
+		t.Error("permission still expired")
+	}
+}
@@ -0,0 +1,5 @@
+module github.com/ricochet2200/gun
+
+go 1.18
+
+require golang.org/x/text v0.14.0
@@ -0,0 +1,30 @@
+package msg
+
+import (
+	"net"
+)
+
+func init() {
+	a := func(t TLVType, b []byte) TLV { return &AlternateServerAttr{NewTLV(t, b)} }
+	RegisterAttributeType(AlternateServer, "Alternate Server", a)
+}
+
+// Where a 300 Try Alternate response sends the client, encoded like
+// MAPPED-ADDRESS
+type AlternateServerAttr struct {
+	TLV
+}
+
+func NewAlternateServer(ip net.IP, port int) *AlternateServerAttr {
+	return &AlternateServerAttr{&TLVBase{AlternateServer, AddrBytes(ip, port)}}
+}
+
+func (this *AlternateServerAttr) IP() (net.IP, error) {
+	ip, _, err := DecodeAddr(this.Value())
+	return ip, err
+}
+
+func (this *AlternateServerAttr) Port() int {
+	_, port, _ := DecodeAddr(this.Value())
+	return port
+}
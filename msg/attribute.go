@@ -1,12 +1,9 @@
 package msg
 
 import (
-	"bytes"
 	"encoding/binary"
 	"io"
-	"strconv"
-	"errors"
-	"log"
+	"fmt"
 )
 
 /*Comprehension-required range (0x0000-0x7FFF):
@@ -49,14 +46,11 @@ var tlvTypeToFunc map[TLVType]func(TLVType, []byte) TLV = make(map[TLVType]func(
 
 func init() {
 
-	f := func(t TLVType, b []byte) TLV{return &TLVBase{t, b}}
 	e := func(t TLVType, b []byte) TLV{return &StunError{&TLVBase{t, b}}}
+	u := func(t TLVType, b []byte) TLV{return &UnknownAttributesAttr{&TLVBase{t, b}}}
 
-	RegisterAttributeType(MappedAddress, "Mapped Address", f)
 	RegisterAttributeType(ErrorCode, "Error Code", e)
-	RegisterAttributeType(UnknownTLVTypes, "Unknown Type", f)
-	RegisterAttributeType(AlternateServer, "Alternative Server", f)
-	RegisterAttributeType(FingerPrint, "Finger Print", f)
+	RegisterAttributeType(UnknownTLVTypes, "Unknown Attributes", u)
 }
 
 func RegisterAttributeType(t TLVType, name string, f func(TLVType,[]byte) TLV) {
@@ -68,14 +62,16 @@ func RegisterAttributeType(t TLVType, name string, f func(TLVType,[]byte) TLV) {
 	tlvTypeToFunc[t] = f
 }
 
-// No need to register these because they are context specific
-type StunErrorCode int16
-const TryAlternative StunErrorCode = 300
-const BadRequest StunErrorCode = 400
-const Unauthorized StunErrorCode = 401
-const UnknownAttribute StunErrorCode = 420
-const StaleNonce StunErrorCode = 438
-const ServerError StunErrorCode = 500
+// Attributes below 0x8000 must be understood, the rest may be ignored
+func (this TLVType) Required() bool {
+	return this < 0x8000
+}
+
+// True if t has been registered
+func KnownAttributeType(t TLVType) bool {
+	_, ok := tlvTypeToFunc[t]
+	return ok
+}
 
 type TLV interface {
 	Type() TLVType
@@ -100,59 +96,86 @@ func NewTLV(t TLVType, v []byte) TLV{
 }
 
 func (this *TLVBase) Encode() []byte {
+	return appendAttr(make([]byte, 0, attrSize(this)), this)
+}
 
-	ret := make([]byte, 0, this.Length())
-	t := []byte{0, 0}
-	binary.BigEndian.PutUint16(t, uint16(this.Type()))
-	ret = append(ret, t...)
+// Appends the attribute's type, length, value and padding to dst
+func appendAttr(dst []byte, tlv TLV) []byte {
 
-	l := []byte{0, 0}
-	binary.BigEndian.PutUint16(l, uint16(this.Length()))
-	ret = append(ret, l...)
+	t := tlv.Type()
+	v := tlv.Value()
+	dst = append(dst, byte(t>>8), byte(t), byte(len(v)>>8), byte(len(v)))
+	dst = append(dst, v...)
 
-	v := this.Value()
-	padding := 4 - (this.Length() % 4)
-	if padding != 4 {
-		v = append(v, make([]byte, padding)...)
+	for padding := (4 - len(v)%4) % 4; padding > 0; padding-- {
+		dst = append(dst, 0)
 	}
-
-	return append(ret, v...)
+	return dst
 }
 
+// Reads one attribute from in, returning it and the padding after it
 func Decode(in io.Reader) (TLV, int, error) {
 
-	buf, err := Read(in, 4)
+	buf, err := readFull(in, 4, false)
 	if err != nil {
-		log.Println("TLV missing header", err)
-		return nil, len(buf), err
+		return nil, 0, err
 	}
 
-	var t TLVType = 0
-	err = binary.Read(bytes.NewBuffer(buf[0:2]), binary.BigEndian, &t)
+	length := int(binary.BigEndian.Uint16(buf[2:4]))
+	rest, err := readFull(in, (length+3)/4*4, true)
 	if err != nil {
-		return nil, len(buf), err
+		return nil, 0, err
 	}
-	
-	var length uint16 = 0
-	err = binary.Read(bytes.NewBuffer(buf[2:4]), binary.BigEndian, &length)
+
+	attr, size, err := decodeAttr(append(buf, rest...))
 	if err != nil {
-		return nil, len(buf), err
+		return nil, 0, err
 	}
+	return attr, size - 4 - length, nil
+}
 
-	v, err := Read(in, int(length))
+// Decodes the attribute at the start of b, returning it and the bytes it
+// takes up with padding
+func decodeAttr(b []byte) (TLV, int, error) {
+	t, v, size, err := parseAttr(b)
 	if err != nil {
-		return nil, len(v) + 4, err
+		return nil, 0, err
+	}
+	return typed(&TLVBase{t, v}), size, nil
+}
+
+func parseAttr(b []byte) (TLVType, []byte, int, error) {
+
+	if len(b) < 4 {
+		return 0, nil, 0, ErrAttrOverflow
+	}
+
+	t := TLVType(binary.BigEndian.Uint16(b[0:2]))
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	size := 4 + (length+3)/4*4
+	if size > len(b) {
+		return 0, nil, 0, ErrAttrOverflow
 	}
 
-	padding := 4 - int(length % 4)
-	if padding != 4 {
-		Read(in, padding)
-	} else {
-		padding = 0
+	// Capped so appending to the value never writes over the next attribute
+	return t, b[4 : 4+length : 4+length], size, nil
+}
+
+// The attribute as its registered type.  Decoded messages hold plain
+// TLVBases and only build the registered types when asked for them.
+// Unknown attributes are kept as they are, see Message.UnknownRequired.
+func typed(tlv TLV) TLV {
+
+	base, ok := tlv.(*TLVBase)
+	if !ok {
+		return tlv
 	}
 
-	attr := tlvTypeToFunc[t](t, v)
-	return attr, padding, nil
+	f, ok := tlvTypeToFunc[base.attrType]
+	if !ok {
+		return tlv
+	}
+	return f(base.attrType, base.value)
 }
 
 func (this *TLVBase) Type() TLVType {
@@ -164,7 +187,7 @@ func (this *TLVBase) TypeString() string {
 	if ok {
 		return v
 	}
-	panic("Unregistered type")
+	return fmt.Sprintf("Unknown 0x%04X", uint16(this.Type()))
 }
 
 func (this *TLVBase) Length() uint16 {
@@ -182,55 +205,3 @@ func (this *TLVBase) ValueToString() string {
 func (this *TLVBase) String() string {
 	return this.TypeString()
 }
-
-type StunError struct {
-	TLV
-}
-
-func NewErrorAttr(code StunErrorCode, msg string) (*StunError, error) {
-
-	class := code / 100
-	if class < 3 || class > 6 {
-		return nil, errors.New("Invalid error code. Valid code:299 < code < 700")
-	}
-	
-	if len(msg) > 128 {
-		return nil, errors.New("Message needs to be under 128 characters")
-	}
-
-	v := []byte{0,0, byte(class), byte(code % 100) }
-	v = append(v, []byte(msg)...)
-
-	return &StunError{&TLVBase{ErrorCode, v}}, nil
-}
-
-func (this *StunError) ErrorString() string {
-	return string(this.Value()[4:])
-}
-
-func (this *StunError) String() string {
-	code, err := this.Code()
-	codeString := strconv.Itoa(int(code))
-	if err != nil {
-		codeString = "Error, Invalid code"
-	}
-	return this.TypeString() + " :\t" + codeString + "\n" + this.ErrorString()
-}
-
-func (this *StunError) Code() (StunErrorCode, error) {
-
-	buf := this.Value()
-	var family uint8 = 0
-	err := binary.Read(bytes.NewBuffer(buf[2:3]), binary.BigEndian, &family)
-	if err != nil {
-		return 0, err
-	}
-
-	var code uint8 = 0
-	err = binary.Read(bytes.NewBuffer(buf[3:4]), binary.BigEndian, &code)
-	if err != nil {
-		return 0, err
-	}
-
-	return StunErrorCode(family) * 100 + StunErrorCode(code), nil
-}
\ No newline at end of file
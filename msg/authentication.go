@@ -2,15 +2,15 @@ package msg
 
 import (
 	"errors"
-	"time"
+	"encoding/base64"
 	"encoding/binary"
 	"crypto/hmac"
 	"crypto/md5"
-	"crypto/sha256"
+	"crypto/sha1"
 	"crypto/subtle"
 	"io"
-	"bytes"
 	"log"
+	"unicode/utf8"
 )
 
 const Username TLVType = 0x0006
@@ -37,8 +37,12 @@ type RealmAttr struct {
 
 func NewRealm(realm string) (*RealmAttr, error) {
 
-	// TODO: Properly process the realm string
-	if len(realm) > 127 {
+	realm, err := PrepareOpaque(realm)
+	if err != nil {
+		return nil, err
+	}
+
+	if utf8.RuneCountInString(realm) > 127 {
 		return nil, errors.New("realm must be under 128 characters")
 	}
 
@@ -53,31 +57,42 @@ type NonceAttr struct {
 	TLV
 }
 
-func NewNonce() (*NonceAttr) {
-	// TODO: Pick a better nonce
-	expires := time.Now().Add(time.Duration(20) * time.Minute)
-	return &NonceAttr{&TLVBase{Nonce, TimeToBytes(expires)}}
-}
+// Nonces starting with NonceCookie advertise the server's security features
+// in the next four characters, RFC 8489 section 9.2
+const NonceCookie = "obMatJos2"
 
-func (this *NonceAttr) String() string {
-	var ret int64 = 0
-	err := binary.Read(bytes.NewBuffer(this.Value()), binary.BigEndian, &ret)
-	if err != nil {
-		return "Error"
+type SecurityFeatures uint32
+
+// Bit 0 is the most significant of the 24 feature bits
+const FeaturePasswordAlgorithms SecurityFeatures = 1 << 23
+const FeatureUsernameAnonymity SecurityFeatures = 1 << 22
+
+// The prefix advertising features, empty when there are none
+func featurePrefix(features SecurityFeatures) []byte {
+	if features == 0 {
+		return []byte{}
 	}
-	
-	return time.Unix(ret, 0).String()
+	b := []byte{byte(features >> 16), byte(features >> 8), byte(features)}
+	return []byte(NonceCookie + base64.StdEncoding.EncodeToString(b))
 }
 
-func ValidNonce(t TLV) bool {
+// The features advertised by the nonce, zero if it has no cookie
+func (this *NonceAttr) Features() SecurityFeatures {
 
-	var ret int64 = 0
-	err := binary.Read(bytes.NewBuffer(t.Value()), binary.BigEndian, &ret)
-	if err != nil {
-		return false
+	v := this.Value()
+	if len(v) < len(NonceCookie)+4 || string(v[:len(NonceCookie)]) != NonceCookie {
+		return 0
 	}
 
-	return time.Unix(ret, 0).After(time.Now())
+	b, err := base64.StdEncoding.DecodeString(string(v[len(NonceCookie) : len(NonceCookie)+4]))
+	if err != nil || len(b) != 3 {
+		return 0
+	}
+	return SecurityFeatures(b[0])<<16 | SecurityFeatures(b[1])<<8 | SecurityFeatures(b[2])
+}
+
+func (this *NonceAttr) String() string {
+	return this.ValueToString()
 }
 
 type UserAttr struct {
@@ -86,7 +101,11 @@ type UserAttr struct {
 
 func NewUser(username string) (*UserAttr, error) {
 	
-	// TODO: clean username with SASLPrep
+	username, err := PrepareUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
 	if len(username) > 512 {
 		return nil, errors.New("User name must be less than 512 bytes")
 	}
@@ -111,57 +130,101 @@ func ToIntegrity(t TLV) *IntegrityAttr {
 }
 
 func NewIntegrityAttr(user, passwd, realm string, msg *Message) *IntegrityAttr {
+	return NewIntegrityAttrKey(LongTermKey(user, realm, passwd), msg)
+}
+
+func NewIntegrityAttrKey(key []byte, msg *Message) *IntegrityAttr {
 	
-	data := CreateHMAC( user, passwd, realm, msg)
+	data := CreateKeyedHMAC(key, msg)
 	
 	return ToIntegrity(&TLVBase{MessageIntegrity, data})
 }
 
 func (this *IntegrityAttr) Valid(user, passwd, realm string, msg *Message) bool {
+	return this.ValidKey(LongTermKey(user, realm, passwd), msg)
+}
+
+func (this *IntegrityAttr) ValidKey(key []byte, msg *Message) bool {
 
 	i, err := msg.Attribute(MessageIntegrity)
 	if err != nil {
 		log.Println("No integrity")
-		return true
+		return false
 	}
 
-	h2 := CreateHMAC(user, passwd, realm, msg)
-	if err != nil {
-		return false 
-	}
+	h2 := CreateKeyedHMAC(key, msg)
 
 	h1 := i.Value()
 	return len(h1) == len(h2) && subtle.ConstantTimeCompare(h1, h2) == 1
 }
 
-func CreateHMAC (user, passwd, realm string, msg *Message) []byte {
+// Key for the long term credential mechanism, MD5(username:realm:password)
+func LongTermKey(user, realm, passwd string) []byte {
 
  	hash := md5.New()
 	key := user + ":" + realm + ":" + passwd
 	io.WriteString(hash, key)
+	return hash.Sum(nil)
+}
+
+// Key for the short term credential mechanism, which is just the password.
+// ICE connectivity checks use these.
+func ShortTermKey(passwd string) []byte {
+	return []byte(passwd)
+}
 
-	mac := hmac.New(sha256.New, hash.Sum(nil))
-	mac.Write(IntegrityCopy(msg).EncodeMessage())
+func CreateHMAC (user, passwd, realm string, msg *Message) []byte {
+	return CreateKeyedHMAC(LongTermKey(user, realm, passwd), msg)
+}
+
+// HMAC-SHA1 of the message as RFC 5389 section 15.4 describes
+func CreateKeyedHMAC(key []byte, msg *Message) []byte {
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(integrityInput(msg, MessageIntegrity, sha1.Size))
 	sum := mac.Sum(nil)
 
 	return sum
 }
 
-func IntegrityCopy (orig *Message) *Message {
-
-	attrs := orig.attr
-	for i := 0; i < len(attrs); i++ {
-		if attrs[i].Type() == FingerPrint || attrs[i].Type() == MessageIntegrity {
-			attrs = append(attrs[:i], attrs[i+1:]...)
-		}	
+// The bytes covered by an integrity attribute of type t whose value is size
+// bytes long.  That is the message up to the attribute, with the length in the
+// header counting everything through it but nothing after.  Decoded messages
+// use the bytes as they were received.
+func integrityInput(msg *Message, t TLVType, size int) []byte {
+
+	var data []byte
+	if offset, ok := msg.offset(t); ok && len(msg.raw) >= offset {
+		data = append(data, msg.raw[:offset]...)
+	} else {
+		data = msg.header.Data()
+		for _, a := range msg.attr {
+			if a.Type() == t {
+				break
+			} else if a.Type() != FingerPrint {
+				data = append(data, a.Encode()...)
+			}
+		}
 	}
 
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)-20+4+size))
+	return data
+}
+
+// A copy of orig without its MESSAGE-INTEGRITY and FINGERPRINT.
+//
+// Deprecated: the HMAC does not cover a copy like this, as the header length
+// must count MESSAGE-INTEGRITY.  Use CreateKeyedHMAC, or NewIntegrityAttrKey
+// and ValidKey, which do that.
+func IntegrityCopy(orig *Message) *Message {
+
 	header := orig.Header().Copy()
 	header.length = 0
-	ret := &Message{header, []TLV{}}
-	for _, a := range attrs {
-		ret.AddAttribute(a)
+	ret := &Message{header: header, attr: []TLV{}}
+	for _, a := range orig.attr {
+		if a.Type() != FingerPrint && a.Type() != MessageIntegrity {
+			ret.AddAttribute(a)
+		}
 	}
-	
 	return ret
-}
\ No newline at end of file
+}
@@ -0,0 +1,124 @@
+package msg
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// NAT behavior discovery attributes, RFC 5780 section 7
+const ChangeRequest TLVType = 0x0003
+const Padding TLVType = 0x0026
+const ResponsePort TLVType = 0x0027
+const ResponseOrigin TLVType = 0x802B
+const OtherAddress TLVType = 0x802C
+
+// Flags in the last byte of CHANGE-REQUEST
+const changeIPFlag byte = 0x04
+const changePortFlag byte = 0x02
+
+func init() {
+	c := func(t TLVType, b []byte) TLV { return &ChangeRequestAttr{NewTLV(t, b)} }
+	p := func(t TLVType, b []byte) TLV { return &PaddingAttr{NewTLV(t, b)} }
+	r := func(t TLVType, b []byte) TLV { return &ResponsePortAttr{NewTLV(t, b)} }
+	ro := func(t TLVType, b []byte) TLV { return &ResponseOriginAttr{NewTLV(t, b)} }
+	o := func(t TLVType, b []byte) TLV { return &OtherAddressAttr{NewTLV(t, b)} }
+
+	RegisterAttributeType(ChangeRequest, "Change Request", c)
+	RegisterAttributeType(Padding, "Padding", p)
+	RegisterAttributeType(ResponsePort, "Response Port", r)
+	RegisterAttributeType(ResponseOrigin, "Response Origin", ro)
+	RegisterAttributeType(OtherAddress, "Other Address", o)
+}
+
+type ChangeRequestAttr struct {
+	TLV
+}
+
+func NewChangeRequest(changeIP, changePort bool) *ChangeRequestAttr {
+	v := []byte{0, 0, 0, 0}
+	if changeIP {
+		v[3] |= changeIPFlag
+	}
+	if changePort {
+		v[3] |= changePortFlag
+	}
+	return &ChangeRequestAttr{&TLVBase{ChangeRequest, v}}
+}
+
+func (this *ChangeRequestAttr) flag(f byte) bool {
+	v := this.Value()
+	return len(v) == 4 && v[3]&f != 0
+}
+
+func (this *ChangeRequestAttr) ChangeIP() bool {
+	return this.flag(changeIPFlag)
+}
+
+func (this *ChangeRequestAttr) ChangePort() bool {
+	return this.flag(changePortFlag)
+}
+
+type PaddingAttr struct {
+	TLV
+}
+
+func NewPadding(length int) *PaddingAttr {
+	return &PaddingAttr{&TLVBase{Padding, make([]byte, length)}}
+}
+
+type ResponsePortAttr struct {
+	TLV
+}
+
+func NewResponsePort(port int) *ResponsePortAttr {
+	v := []byte{0, 0}
+	binary.BigEndian.PutUint16(v, uint16(port))
+	return &ResponsePortAttr{&TLVBase{ResponsePort, v}}
+}
+
+func (this *ResponsePortAttr) Port() int {
+	v := this.Value()
+	if len(v) < 2 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(v[0:2]))
+}
+
+// The address the response was sent from
+type ResponseOriginAttr struct {
+	TLV
+}
+
+func NewResponseOrigin(ip net.IP, port int) *ResponseOriginAttr {
+	return &ResponseOriginAttr{&TLVBase{ResponseOrigin, AddrBytes(ip, port)}}
+}
+
+func (this *ResponseOriginAttr) IP() (net.IP, error) {
+	ip, _, err := DecodeAddr(this.Value())
+	return ip, err
+}
+
+func (this *ResponseOriginAttr) Port() int {
+	_, port, _ := DecodeAddr(this.Value())
+	return port
+}
+
+// The server address that differs from the one the request was sent to in
+// both IP and port
+type OtherAddressAttr struct {
+	TLV
+}
+
+func NewOtherAddress(ip net.IP, port int) *OtherAddressAttr {
+	return &OtherAddressAttr{&TLVBase{OtherAddress, AddrBytes(ip, port)}}
+}
+
+func (this *OtherAddressAttr) IP() (net.IP, error) {
+	ip, _, err := DecodeAddr(this.Value())
+	return ip, err
+}
+
+func (this *OtherAddressAttr) Port() int {
+	_, port, _ := DecodeAddr(this.Value())
+	return port
+}
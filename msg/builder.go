@@ -0,0 +1,143 @@
+package msg
+
+import (
+	"net"
+)
+
+// Message types for Build
+const BindingRequest = Binding | Request
+const BindingSuccess = Binding | Success
+const BindingError = Binding | Error
+const BindingIndication = Binding | Indication
+
+// Options are applied by Build in phases rather than in the order given, so
+// the transaction id is set before addresses are XORed with it, and the
+// message always ends with MESSAGE-INTEGRITY, MESSAGE-INTEGRITY-SHA256 then
+// FINGERPRINT, RFC 8489 section 14
+const (
+	headerPhase = iota
+	attributePhase
+	integrityPhase
+	integritySHA256Phase
+	fingerprintPhase
+)
+
+type BuildOption struct {
+	phase int
+	apply func(*Message) error
+}
+
+// Builds a message of type t, for example
+//	msg.Build(msg.BindingSuccess, msg.ResponseTo(req),
+//		msg.WithXORMappedAddress(addr), msg.WithFingerprint())
+func Build(t MessageType, opts ...BuildOption) (*Message, error) {
+
+	m := NewRequest(t)
+	for phase := headerPhase; phase <= fingerprintPhase; phase++ {
+		for _, o := range opts {
+			if o.phase != phase {
+				continue
+			}
+			if err := o.apply(m); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+func attributeOption(f func(*Message) (TLV, error)) BuildOption {
+	return BuildOption{attributePhase, func(m *Message) error {
+		tlv, err := f(m)
+		if err != nil {
+			return err
+		}
+		m.AddAttribute(tlv)
+		return nil
+	}}
+}
+
+// Uses the transaction id of req, as responses must
+func ResponseTo(req *Message) BuildOption {
+	return BuildOption{headerPhase, func(m *Message) error {
+		m.header.id = append([]byte{}, req.header.id...)
+		m.header.legacy = req.header.legacy
+		return nil
+	}}
+}
+
+func WithTransactionId(id []byte) BuildOption {
+	return BuildOption{headerPhase, func(m *Message) error {
+		m.header.id = append([]byte{}, id...)
+		return nil
+	}}
+}
+
+func WithAttribute(tlv TLV) BuildOption {
+	return attributeOption(func(m *Message) (TLV, error) { return tlv, nil })
+}
+
+func WithXORMappedAddress(addr *net.UDPAddr) BuildOption {
+	return attributeOption(func(m *Message) (TLV, error) {
+		return NewXORAddress(addr.IP, addr.Port, m.header), nil
+	})
+}
+
+func WithMappedAddress(addr *net.UDPAddr) BuildOption {
+	return attributeOption(func(m *Message) (TLV, error) {
+		return NewMappedAddress(addr.IP, addr.Port), nil
+	})
+}
+
+func WithErrorCode(code StunErrorCode, reason string) BuildOption {
+	return attributeOption(func(m *Message) (TLV, error) {
+		return NewErrorAttr(code, reason)
+	})
+}
+
+func WithUsername(user string) BuildOption {
+	return attributeOption(func(m *Message) (TLV, error) {
+		return NewUser(user)
+	})
+}
+
+func WithRealm(realm string) BuildOption {
+	return attributeOption(func(m *Message) (TLV, error) {
+		return NewRealm(realm)
+	})
+}
+
+func WithSoftware(description string) BuildOption {
+	return attributeOption(func(m *Message) (TLV, error) {
+		return NewSoftware(description)
+	})
+}
+
+func WithNonce(nonce *NonceAttr) BuildOption {
+	return WithAttribute(nonce)
+}
+
+// Adds MESSAGE-INTEGRITY keyed with key, after every other attribute but the
+// fingerprint
+func WithIntegrity(key []byte) BuildOption {
+	return BuildOption{integrityPhase, func(m *Message) error {
+		m.AddAttribute(NewIntegrityAttrKey(key, m))
+		return nil
+	}}
+}
+
+// Like WithIntegrity but adds MESSAGE-INTEGRITY-SHA256, after
+// MESSAGE-INTEGRITY when both are given
+func WithIntegritySHA256(key []byte) BuildOption {
+	return BuildOption{integritySHA256Phase, func(m *Message) error {
+		m.AddAttribute(NewIntegritySHA256(key, m))
+		return nil
+	}}
+}
+
+func WithFingerprint() BuildOption {
+	return BuildOption{fingerprintPhase, func(m *Message) error {
+		m.AddFingerprint()
+		return nil
+	}}
+}
@@ -0,0 +1,58 @@
+package msg
+
+import (
+	"net"
+	"testing"
+)
+
+// Whatever order the options come in, the message ends with
+// MESSAGE-INTEGRITY, MESSAGE-INTEGRITY-SHA256 and FINGERPRINT
+func TestBuildOrder(t *testing.T) {
+
+	key := []byte("key")
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4242}
+	orders := [][]BuildOption{
+		{WithIntegrity(key), WithIntegritySHA256(key), WithFingerprint(), WithXORMappedAddress(addr)},
+		{WithFingerprint(), WithIntegritySHA256(key), WithIntegrity(key), WithXORMappedAddress(addr)},
+		{WithXORMappedAddress(addr), WithIntegritySHA256(key), WithFingerprint(), WithIntegrity(key)},
+	}
+	want := []TLVType{XORMappedAddress, MessageIntegrity, MessageIntegritySHA256, FingerPrint}
+
+	for i, opts := range orders {
+		m, err := Build(BindingRequest, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(m.attr) != len(want) {
+			t.Fatalf("%d: %d attributes", i, len(m.attr))
+		}
+		for j, a := range m.attr {
+			if a.Type() != want[j] {
+				t.Errorf("%d: attribute %d is %s, want 0x%04X", i, j, a.TypeString(), uint16(want[j]))
+			}
+		}
+
+		// Each covers everything before it
+		d := &Message{}
+		if err := d.UnmarshalBinary(m.EncodeMessage()); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		mi, _ := d.Attribute(MessageIntegrity)
+		sha, _ := d.Attribute(MessageIntegritySHA256)
+		if !ToIntegrity(mi).ValidKey(key, d) || !sha.(*IntegritySHA256Attr).ValidKey(key, d) {
+			t.Errorf("%d: integrity does not validate", i)
+		}
+	}
+}
+
+func TestBuildIntegritySHA256Only(t *testing.T) {
+
+	m, err := Build(BindingRequest, WithFingerprint(), WithIntegritySHA256([]byte("key")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.attr) != 2 || m.attr[0].Type() != MessageIntegritySHA256 || m.attr[1].Type() != FingerPrint {
+		t.Fatalf("got %v", m)
+	}
+}
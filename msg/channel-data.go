@@ -0,0 +1,53 @@
+package msg
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Channel numbers a client may bind, RFC 5766 section 11
+const MinChannel uint16 = 0x4000
+const MaxChannel uint16 = 0x7FFE
+
+// TURN ChannelData message, sent in place of Send and Data indications once a
+// channel is bound to a peer
+type ChannelData struct {
+	Channel uint16
+	Data    []byte
+}
+
+// True if b starts with a ChannelData header rather than a STUN header.  The
+// first two bits of a STUN message are always 0, for ChannelData they are 01.
+func IsChannelData(b []byte) bool {
+	return len(b) >= 4 && b[0]&0xC0 == 0x40
+}
+
+func DecodeChannelData(b []byte) (*ChannelData, error) {
+
+	if !IsChannelData(b) {
+		return nil, errors.New("Not a ChannelData message")
+	}
+
+	channel := binary.BigEndian.Uint16(b[0:2])
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if len(b)-4 < length {
+		return nil, errors.New("ChannelData shorter than its length")
+	}
+
+	return &ChannelData{channel, b[4 : 4+length]}, nil
+}
+
+// Encodes the message padded to a multiple of 4 bytes, which stream
+// transports require and datagrams allow
+func (this *ChannelData) Encode() []byte {
+
+	ret := make([]byte, 4, 4+len(this.Data)+3)
+	binary.BigEndian.PutUint16(ret[0:2], this.Channel)
+	binary.BigEndian.PutUint16(ret[2:4], uint16(len(this.Data)))
+	ret = append(ret, this.Data...)
+
+	if padding := len(ret) % 4; padding != 0 {
+		ret = append(ret, make([]byte, 4-padding)...)
+	}
+	return ret
+}
@@ -0,0 +1,133 @@
+package msg
+
+import (
+	"errors"
+	"strconv"
+	"unicode/utf8"
+)
+
+type StunErrorCode int16
+
+const TryAlternative StunErrorCode = 300
+const BadRequest StunErrorCode = 400
+const Unauthorized StunErrorCode = 401
+const Forbidden StunErrorCode = 403
+const UnknownAttribute StunErrorCode = 420
+const AllocationMismatch StunErrorCode = 437
+const StaleNonce StunErrorCode = 438
+const AddressFamilyNotSupported StunErrorCode = 440
+const WrongCredentials StunErrorCode = 441
+const UnsupportedTransport StunErrorCode = 442
+const AllocationQuota StunErrorCode = 486
+const RoleConflict StunErrorCode = 487
+const ServerError StunErrorCode = 500
+const InsufficientCapacity StunErrorCode = 508
+
+var errorCodeToReason map[StunErrorCode]string = make(map[StunErrorCode]string)
+
+func init() {
+	RegisterErrorCode(TryAlternative, "Try Alternate")
+	RegisterErrorCode(BadRequest, "Bad Request")
+	RegisterErrorCode(Unauthorized, "Unauthorized")
+	RegisterErrorCode(Forbidden, "Forbidden")
+	RegisterErrorCode(UnknownAttribute, "Unknown Attribute")
+	RegisterErrorCode(AllocationMismatch, "Allocation Mismatch")
+	RegisterErrorCode(StaleNonce, "Stale Nonce")
+	RegisterErrorCode(AddressFamilyNotSupported, "Address Family not Supported")
+	RegisterErrorCode(WrongCredentials, "Wrong Credentials")
+	RegisterErrorCode(UnsupportedTransport, "Unsupported Transport Protocol")
+	RegisterErrorCode(AllocationQuota, "Allocation Quota Reached")
+	RegisterErrorCode(RoleConflict, "Role Conflict")
+	RegisterErrorCode(ServerError, "Server Error")
+	RegisterErrorCode(InsufficientCapacity, "Insufficient Capacity")
+}
+
+// Sets the reason phrase used for code when none is given
+func RegisterErrorCode(code StunErrorCode, reason string) {
+	if _, contains := errorCodeToReason[code]; contains {
+		panic("Error code already registered")
+	}
+	errorCodeToReason[code] = reason
+}
+
+// The registered reason phrase for code, empty if there is none
+func ErrorReason(code StunErrorCode) string {
+	return errorCodeToReason[code]
+}
+
+// An ERROR-CODE attribute, RFC 5389 section 15.6.  It is also an error, so
+// the code of an error response can be found with errors.As.
+type StunError struct {
+	TLV
+}
+
+// An empty reason uses the one registered for code
+func NewErrorAttr(code StunErrorCode, reason string) (*StunError, error) {
+
+	class := code / 100
+	if class < 3 || class > 6 {
+		return nil, errors.New("Invalid error code. Valid code:299 < code < 700")
+	}
+
+	if reason == "" {
+		reason = ErrorReason(code)
+	}
+
+	if utf8.RuneCountInString(reason) > 127 || len(reason) > 763 {
+		return nil, errors.New("Reason needs to be under 128 characters")
+	}
+
+	v := make([]byte, 4, 4+len(reason))
+	v[2] = byte(class)
+	v[3] = byte(code % 100)
+	v = append(v, reason...)
+
+	return &StunError{&TLVBase{ErrorCode, v}}, nil
+}
+
+func (this *StunError) ErrorString() string {
+	v := this.Value()
+	if len(v) < 4 {
+		return ""
+	}
+	return string(v[4:])
+}
+
+func (this *StunError) String() string {
+	code, err := this.Code()
+	codeString := strconv.Itoa(int(code))
+	if err != nil {
+		codeString = "Error, Invalid code"
+	}
+	return this.TypeString() + " :\t" + codeString + "\n" + this.ErrorString()
+}
+
+// The code and reason phrase, such as "438 Stale Nonce"
+func (this *StunError) Error() string {
+
+	code, err := this.Code()
+	if err != nil {
+		return err.Error()
+	}
+
+	reason := this.ErrorString()
+	if reason == "" {
+		reason = ErrorReason(code)
+	}
+	return strconv.Itoa(int(code)) + " " + reason
+}
+
+func (this *StunError) Code() (StunErrorCode, error) {
+
+	buf := this.Value()
+	if len(buf) < 4 {
+		return 0, errors.New("Error code attribute too short")
+	}
+
+	class := StunErrorCode(buf[2] & 0x07)
+	number := StunErrorCode(buf[3])
+	if class < 3 || class > 6 || number > 99 {
+		return 0, errors.New("Invalid error code")
+	}
+	return class*100 + number, nil
+}
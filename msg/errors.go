@@ -0,0 +1,30 @@
+package msg
+
+import (
+	"errors"
+	"io"
+)
+
+// Errors from decoding, for use with errors.Is
+var ErrTruncated = errors.New("Message truncated")
+var ErrBadCookie = errors.New("Magic cookie is inedible")
+var ErrBadType = errors.New("Bad message type")
+var ErrUnaligned = errors.New("Message length not a multiple of 4")
+var ErrTooLarge = errors.New("Message too large")
+var ErrAttrOverflow = errors.New("Attribute overflows message")
+var ErrFingerprintPosition = errors.New("Fingerprint is not the last attribute")
+var ErrFingerprintMismatch = errors.New("Fingerprint does not match")
+
+// Largest message, header included, the decoder accepts
+const MaxMessageSize = 16384
+
+// Reads exactly n bytes.  A stream that ends part way is ErrTruncated, one
+// that ends before anything was read is io.EOF unless mid is true.
+func readFull(in io.Reader, n int, mid bool) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(in, buf)
+	if err == io.ErrUnexpectedEOF || (err == io.EOF && mid) {
+		return nil, ErrTruncated
+	}
+	return buf, err
+}
@@ -0,0 +1,48 @@
+package msg
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"strconv"
+)
+
+// XORed with the CRC-32 so FINGERPRINT differs from CRCs in other protocols
+const FingerprintXOR uint32 = 0x5354554e
+
+func init() {
+	f := func(t TLVType, b []byte) TLV { return &FingerprintAttr{NewTLV(t, b)} }
+	RegisterAttributeType(FingerPrint, "Finger Print", f)
+}
+
+type FingerprintAttr struct {
+	TLV
+}
+
+// CRC-32 of data XOR FingerprintXOR, see RFC 5389 section 15.5
+func Fingerprint(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data) ^ FingerprintXOR
+}
+
+func NewFingerprint(sum uint32) *FingerprintAttr {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, sum)
+	return &FingerprintAttr{&TLVBase{FingerPrint, v}}
+}
+
+func (this *FingerprintAttr) Sum() uint32 {
+	v := this.Value()
+	if len(v) != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+// Checks the fingerprint against data, the encoded message up to but not
+// including this attribute
+func (this *FingerprintAttr) Valid(data []byte) bool {
+	return len(this.Value()) == 4 && this.Sum() == Fingerprint(data)
+}
+
+func (this *FingerprintAttr) String() string {
+	return this.TypeString() + " :\t" + strconv.FormatUint(uint64(this.Sum()), 16)
+}
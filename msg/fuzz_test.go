@@ -0,0 +1,663 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func FuzzDecodeMessage(f *testing.F) {
+
+	for _, v := range []string{longTermRequest, shortTermRequest, ipv4Response, ipv6Response} {
+		f.Add(vector(f, v))
+	}
+
+	req := NewRequest(Binding | Request)
+	e, _ := NewErrorAttr(StaleNonce, "")
+	req.AddAttribute(e)
+	req.AddAttribute(NewUnknownAttributes([]TLVType{0x0002, 0x7FFF}))
+	req.AddAttribute(NewPasswordAlgorithms(AlgorithmSHA256, AlgorithmMD5))
+	req.AddFingerprint()
+	f.Add(req.EncodeMessage())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		if m, err := DecodeMessage(bytes.NewReader(data)); err == nil {
+			exerciseMessage(m)
+		}
+		if m, err := DecodeLegacyMessage(bytes.NewReader(data)); err == nil {
+			exerciseMessage(m)
+		}
+
+		m := &Message{}
+		if err := m.UnmarshalLegacy(data); err != nil {
+			return
+		}
+		exerciseMessage(m)
+
+		// Whatever decodes must encode to something that decodes the same
+		again := &Message{}
+		if err := again.UnmarshalLegacy(m.EncodeMessage()); err != nil && err != ErrFingerprintMismatch {
+			t.Fatal("re-encoded message does not decode:", err)
+		}
+	})
+}
+
+// Calls every getter, none may panic whatever the message holds
+func exerciseMessage(m *Message) {
+
+	_ = m.String()
+	m.UnknownRequired()
+	m.XORMappedAddress()
+	m.XORPeerAddress()
+	m.XORRelayedAddress()
+	m.MappedAddress()
+	m.AlternateServer()
+	m.ErrorCode()
+	m.Username()
+	m.Realm()
+	m.Software()
+	m.Nonce()
+
+	for _, a := range m.attr {
+		exerciseAttr(m, typed(a))
+	}
+}
+
+// Calls every accessor of a registered attribute type
+func exerciseAttr(m *Message, a TLV) {
+
+	_ = a.String()
+	switch v := a.(type) {
+	case *AlternateServerAttr:
+		v.IP()
+		v.Port()
+	case *StunError:
+		v.Code()
+		v.ErrorString()
+		_ = v.Error()
+	case *UnknownAttributesAttr:
+		v.Types()
+	case *IntegrityAttr:
+		v.ValidKey([]byte("key"), m)
+	case *NonceAttr:
+		v.Features()
+		NewNonceSigner([]byte("secret")).Valid(v, net.IPv4(192, 0, 2, 1))
+	case *ChangeRequestAttr:
+		v.ChangeIP()
+		v.ChangePort()
+	case *ResponsePortAttr:
+		v.Port()
+	case *ResponseOriginAttr:
+		v.IP()
+		v.Port()
+	case *OtherAddressAttr:
+		v.IP()
+		v.Port()
+	case *FingerprintAttr:
+		v.Sum()
+		v.Valid(m.raw)
+	case *PriorityAttr:
+		v.Priority()
+	case *IceRoleAttr:
+		v.Controlling()
+		v.TieBreaker()
+	case *MappedAddressAttr:
+		v.IP()
+		v.Port()
+	case *IntegritySHA256Attr:
+		v.ValidKey([]byte("key"), m)
+	case *PasswordAlgorithmAttr:
+		v.Algorithm()
+	case *PasswordAlgorithmsAttr:
+		v.Algorithms()
+		v.Contains(AlgorithmSHA256)
+	case *SoftwareAttr:
+		v.Description()
+	case *ChannelNumberAttr:
+		v.Channel()
+	case *LifetimeAttr:
+		v.Lifetime()
+	case *RequestedTransportAttr:
+		v.Protocol()
+	case *UserHashAttr:
+		v.Hash()
+	case *XORAddress:
+		v.IP(m.Header())
+		v.Port()
+	}
+}
+
+// Decodes value as an attribute of type t, both on its own and inside a
+// message, then calls every accessor
+func fuzzValue(t TLVType, value []byte) {
+
+	m := NewRequest(Binding | Request)
+	exerciseAttr(m, typed(&TLVBase{t, value}))
+
+	if len(value) > 0xFFFF {
+		return
+	}
+	m.AddAttribute(&TLVBase{t, value})
+	decoded := &Message{}
+	if decoded.UnmarshalBinary(m.EncodeMessage()) == nil {
+		exerciseMessage(decoded)
+	}
+}
+
+// Longest value built into a message, well under MaxMessageSize
+const maxFuzzLen = 4096
+
+// Adds a to a message, encodes and decodes it, and returns the decoded
+// attribute
+func reread(t *testing.T, m *Message, a TLV) TLV {
+
+	m.AddAttribute(a)
+	decoded := &Message{}
+	if err := decoded.UnmarshalBinary(m.EncodeMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := decoded.Attribute(a.Type())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ret.Value(), a.Value()) {
+		t.Fatalf("value changed from %x to %x", a.Value(), ret.Value())
+	}
+	return ret
+}
+
+// An address and port taken from the start of data
+func fuzzAddr(data []byte) (net.IP, int) {
+
+	port := 0
+	if len(data) >= 2 {
+		port = int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+
+	if len(data) >= net.IPv6len {
+		return net.IP(data[:net.IPv6len]), port
+	} else if len(data) >= net.IPv4len {
+		return net.IP(data[:net.IPv4len]), port
+	}
+	return net.IPv4zero, port
+}
+
+func checkAddr(t *testing.T, ip, gotIP net.IP, port, gotPort int, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(gotIP) || port != gotPort {
+		t.Fatalf("%v:%d decoded as %v:%d", ip, port, gotIP, gotPort)
+	}
+}
+
+func fuzzUint(data []byte) uint64 {
+	var b [8]byte
+	copy(b[:], data)
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func FuzzMappedAddress(f *testing.F) {
+	f.Add([]byte{0, FamilyIPv4, 0x11, 0x22, 192, 0, 2, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(MappedAddress, data)
+
+		ip, port := fuzzAddr(data)
+		a := reread(t, NewRequest(Binding|Request), NewMappedAddress(ip, port)).(*MappedAddressAttr)
+		gotIP, err := a.IP()
+		checkAddr(t, ip, gotIP, port, a.Port(), err)
+	})
+}
+
+func FuzzXORMappedAddress(f *testing.F) {
+	fuzzXORAddress(f, XORMappedAddress, NewXORAddress)
+}
+
+func FuzzXORPeerAddress(f *testing.F) {
+	fuzzXORAddress(f, XORPeerAddress, NewXORPeerAddress)
+}
+
+func FuzzXORRelayedAddress(f *testing.F) {
+	fuzzXORAddress(f, XORRelayedAddress, NewXORRelayedAddress)
+}
+
+func fuzzXORAddress(f *testing.F, typ TLVType, build func(net.IP, int, *Header) *XORAddress) {
+	f.Add([]byte{0, FamilyIPv4, 0xa1, 0x47, 0xe1, 0x12, 0xa6, 0x43})
+	f.Add(append([]byte{0, FamilyIPv6, 0xa1, 0x47}, make([]byte, 16)...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(typ, data)
+
+		m := NewRequest(Binding | Request)
+		ip, port := fuzzAddr(data)
+		a := reread(t, m, build(ip, port, m.Header())).(*XORAddress)
+		gotIP, err := a.IP(m.Header())
+		checkAddr(t, ip, gotIP, port, a.Port(), err)
+	})
+}
+
+func FuzzAlternateServer(f *testing.F) {
+	fuzzAddress(f, AlternateServer, func(ip net.IP, port int) addressAttr {
+		return NewAlternateServer(ip, port)
+	})
+}
+
+func FuzzResponseOrigin(f *testing.F) {
+	fuzzAddress(f, ResponseOrigin, func(ip net.IP, port int) addressAttr {
+		return NewResponseOrigin(ip, port)
+	})
+}
+
+func FuzzOtherAddress(f *testing.F) {
+	fuzzAddress(f, OtherAddress, func(ip net.IP, port int) addressAttr {
+		return NewOtherAddress(ip, port)
+	})
+}
+
+type addressAttr interface {
+	TLV
+	IP() (net.IP, error)
+	Port() int
+}
+
+func fuzzAddress(f *testing.F, typ TLVType, build func(net.IP, int) addressAttr) {
+	f.Add([]byte{0, FamilyIPv4, 0x11, 0x22, 192, 0, 2, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(typ, data)
+
+		ip, port := fuzzAddr(data)
+		a := reread(t, NewRequest(Binding|Request), build(ip, port)).(addressAttr)
+		gotIP, err := a.IP()
+		checkAddr(t, ip, gotIP, port, a.Port(), err)
+	})
+}
+
+func FuzzErrorCode(f *testing.F) {
+	f.Add([]byte{0, 0, 4, 38, 'S', 't', 'a', 'l', 'e'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(ErrorCode, data)
+
+		if len(data) < 2 {
+			return
+		}
+		code := StunErrorCode(binary.BigEndian.Uint16(data))
+		reason := string(data[2:])
+		e, err := NewErrorAttr(code, reason)
+		if err != nil {
+			return
+		}
+
+		got := reread(t, NewRequest(Binding|Error), e).(*StunError)
+		gotCode, err := got.Code()
+		if err != nil || gotCode != code {
+			t.Fatalf("code %d decoded as %d, %v", code, gotCode, err)
+		}
+		if reason != "" && got.ErrorString() != reason {
+			t.Fatalf("reason %+q decoded as %+q", reason, got.ErrorString())
+		}
+	})
+}
+
+func FuzzUnknownAttributes(f *testing.F) {
+	f.Add([]byte{0x00, 0x02, 0x7F, 0xFF})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(UnknownTLVTypes, data)
+
+		types := []TLVType{}
+		for i := 0; i+1 < len(data) && len(types) < 1000; i += 2 {
+			types = append(types, TLVType(binary.BigEndian.Uint16(data[i:])))
+		}
+
+		got := reread(t, NewRequest(Binding|Error), NewUnknownAttributes(types)).(*UnknownAttributesAttr).Types()
+		if len(got) != len(types) {
+			t.Fatalf("%v decoded as %v", types, got)
+		}
+		for i := range got {
+			if got[i] != types[i] {
+				t.Fatalf("%v decoded as %v", types, got)
+			}
+		}
+	})
+}
+
+func FuzzUsername(f *testing.F) {
+	f.Add([]byte("マトリックス"))
+	f.Add([]byte("evtj:h6vY"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(Username, data)
+
+		u, err := NewUser(string(data))
+		if err != nil {
+			return
+		}
+		got := reread(t, NewRequest(Binding|Request), u).(*UserAttr).User()
+
+		// Preparing is idempotent, so the server gets the same username
+		again, err := PrepareUsername(got)
+		if err != nil || again != got {
+			t.Fatalf("%+q prepared again as %+q, %v", got, again, err)
+		}
+	})
+}
+
+func FuzzRealm(f *testing.F) {
+	f.Add([]byte("example.org"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(Realm, data)
+
+		r, err := NewRealm(string(data))
+		if err != nil {
+			return
+		}
+		got := reread(t, NewRequest(Binding|Request), r).(*RealmAttr).String()
+
+		again, err := PrepareOpaque(got)
+		if err != nil || again != got {
+			t.Fatalf("%+q prepared again as %+q, %v", got, again, err)
+		}
+	})
+}
+
+func FuzzSoftware(f *testing.F) {
+	f.Add([]byte("STUN test client"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(Software, data)
+
+		s, err := NewSoftware(string(data))
+		if err != nil {
+			return
+		}
+		got := reread(t, NewRequest(Binding|Request), s).(*SoftwareAttr).Description()
+		if got != string(data) {
+			t.Fatalf("%+q decoded as %+q", data, got)
+		}
+	})
+}
+
+func FuzzNonce(f *testing.F) {
+	f.Add([]byte(NonceCookie + "AAAAAA"))
+	f.Add([]byte("f//499k954d6OL34oL9FSTvy64sA"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(Nonce, data)
+
+		// Nonces the signer issues are valid, for that address only
+		signer := NewNonceSigner(data)
+		ip := net.IP(data)
+		if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+			ip = net.IPv4(192, 0, 2, 1)
+		}
+		features := SecurityFeatures(fuzzUint(data)) & 0xFFFFFF
+
+		n := reread(t, NewRequest(Binding|Error), signer.Nonce(ip, features)).(*NonceAttr)
+		if !signer.Valid(n, ip) {
+			t.Fatal("issued nonce is not valid")
+		}
+		if features != 0 && n.Features() != features {
+			t.Fatalf("features %x decoded as %x", features, n.Features())
+		}
+		if signer.Valid(n, net.IPv6loopback) {
+			t.Fatal("nonce is valid for another address")
+		}
+	})
+}
+
+func FuzzMessageIntegrity(f *testing.F) {
+	f.Add([]byte("key"), make([]byte, 20))
+	f.Fuzz(func(t *testing.T, key, data []byte) {
+		fuzzValue(MessageIntegrity, data)
+
+		if len(data) > maxFuzzLen {
+			return
+		}
+
+		m := NewRequest(Binding | Request)
+		m.AddAttribute(NewDataAttr(data))
+		i := reread(t, m, NewIntegrityAttrKey(key, m))
+
+		decoded := &Message{}
+		decoded.UnmarshalBinary(m.EncodeMessage())
+		if !ToIntegrity(i).ValidKey(key, decoded) {
+			t.Fatal("MESSAGE-INTEGRITY does not validate")
+		}
+	})
+}
+
+func FuzzMessageIntegritySHA256(f *testing.F) {
+	f.Add([]byte("key"), make([]byte, 32))
+	f.Fuzz(func(t *testing.T, key, data []byte) {
+		fuzzValue(MessageIntegritySHA256, data)
+
+		if len(data) > maxFuzzLen {
+			return
+		}
+
+		m := NewRequest(Binding | Request)
+		m.AddAttribute(NewDataAttr(data))
+		i := reread(t, m, NewIntegritySHA256(key, m))
+
+		decoded := &Message{}
+		decoded.UnmarshalBinary(m.EncodeMessage())
+		if !i.(*IntegritySHA256Attr).ValidKey(key, decoded) {
+			t.Fatal("MESSAGE-INTEGRITY-SHA256 does not validate")
+		}
+	})
+}
+
+func FuzzFingerprint(f *testing.F) {
+	f.Add([]byte{0xe5, 0x7a, 0x3b, 0xcf})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(FingerPrint, data)
+
+		// Whatever comes before it, the fingerprint checks out
+		if len(data) > maxFuzzLen {
+			return
+		}
+
+		m := NewRequest(Binding | Request)
+		m.AddAttribute(NewDataAttr(data))
+		m.AddFingerprint()
+		decoded := &Message{}
+		if err := decoded.UnmarshalBinary(m.EncodeMessage()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func FuzzChangeRequest(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 6})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(ChangeRequest, data)
+
+		ip, port := fuzzUint(data)&1 != 0, fuzzUint(data)&2 != 0
+		c := reread(t, NewRequest(Binding|Request), NewChangeRequest(ip, port)).(*ChangeRequestAttr)
+		if c.ChangeIP() != ip || c.ChangePort() != port {
+			t.Fatal("change request flags changed")
+		}
+	})
+}
+
+func FuzzPadding(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(Padding, data)
+		if len(data) <= maxFuzzLen {
+			reread(t, NewRequest(Binding|Request), NewPadding(len(data)))
+		}
+	})
+}
+
+func FuzzResponsePort(f *testing.F) {
+	f.Add([]byte{0x11, 0x22, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(ResponsePort, data)
+
+		port := int(uint16(fuzzUint(data)))
+		if got := reread(t, NewRequest(Binding|Request), NewResponsePort(port)).(*ResponsePortAttr).Port(); got != port {
+			t.Fatalf("port %d decoded as %d", port, got)
+		}
+	})
+}
+
+func FuzzPriority(f *testing.F) {
+	f.Add([]byte{0x6e, 0, 1, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(Priority, data)
+
+		p := uint32(fuzzUint(data))
+		if got := reread(t, NewRequest(Binding|Request), NewPriority(p)).(*PriorityAttr).Priority(); got != p {
+			t.Fatalf("priority %d decoded as %d", p, got)
+		}
+	})
+}
+
+func FuzzUseCandidate(f *testing.F) {
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(UseCandidate, data)
+		reread(t, NewRequest(Binding|Request), NewUseCandidate())
+	})
+}
+
+func FuzzIceControlled(f *testing.F) {
+	fuzzIceRole(f, IceControlled, NewIceControlled)
+}
+
+func FuzzIceControlling(f *testing.F) {
+	fuzzIceRole(f, IceControlling, NewIceControlling)
+}
+
+func fuzzIceRole(f *testing.F, typ TLVType, build func(uint64) *IceRoleAttr) {
+	f.Add([]byte{0x93, 0x2f, 0xf9, 0xb1, 0x51, 0x26, 0x3b, 0x36})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(typ, data)
+
+		tb := fuzzUint(data)
+		r := reread(t, NewRequest(Binding|Request), build(tb)).(*IceRoleAttr)
+		if r.TieBreaker() != tb || r.Controlling() != (typ == IceControlling) {
+			t.Fatal("ICE role changed")
+		}
+	})
+}
+
+func FuzzPasswordAlgorithm(f *testing.F) {
+	f.Add([]byte{0, 2, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(PasswordAlgorithm, data)
+
+		alg := PasswordAlgorithmID(fuzzUint(data))
+		a := reread(t, NewRequest(Binding|Request), NewPasswordAlgorithm(alg)).(*PasswordAlgorithmAttr)
+		if a.Algorithm() != alg {
+			t.Fatalf("algorithm %d decoded as %d", alg, a.Algorithm())
+		}
+	})
+}
+
+func FuzzPasswordAlgorithms(f *testing.F) {
+	f.Add([]byte{0, 2, 0, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(PasswordAlgorithms, data)
+
+		algs := []PasswordAlgorithmID{}
+		for i := 0; i+1 < len(data) && len(algs) < 1000; i += 2 {
+			algs = append(algs, PasswordAlgorithmID(binary.BigEndian.Uint16(data[i:])))
+		}
+
+		got := reread(t, NewRequest(Binding|Error), NewPasswordAlgorithms(algs...)).(*PasswordAlgorithmsAttr)
+		for _, alg := range algs {
+			if !got.Contains(alg) {
+				t.Fatalf("%v decoded as %v", algs, got.Algorithms())
+			}
+		}
+	})
+}
+
+func FuzzUserHash(f *testing.F) {
+	f.Add([]byte("マトリックス"), []byte("example.org"))
+	f.Fuzz(func(t *testing.T, user, realm []byte) {
+		fuzzValue(UserHash, user)
+
+		h := reread(t, NewRequest(Binding|Request), NewUserHash(string(user), string(realm))).(*UserHashAttr)
+		if !bytes.Equal(h.Hash(), HashUser(string(user), string(realm))) {
+			t.Fatal("user hash changed")
+		}
+	})
+}
+
+func FuzzChannelNumber(f *testing.F) {
+	f.Add([]byte{0x40, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(ChannelNumber, data)
+
+		c := uint16(fuzzUint(data))
+		if got := reread(t, NewRequest(Binding|Request), NewChannelNumber(c)).(*ChannelNumberAttr).Channel(); got != c {
+			t.Fatalf("channel %d decoded as %d", c, got)
+		}
+	})
+}
+
+func FuzzLifetime(f *testing.F) {
+	f.Add([]byte{0, 0, 2, 0x58})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(Lifetime, data)
+
+		d := time.Duration(uint32(fuzzUint(data))) * time.Second
+		if got := reread(t, NewRequest(Binding|Request), NewLifetime(d)).(*LifetimeAttr).Lifetime(); got != d {
+			t.Fatalf("lifetime %v decoded as %v", d, got)
+		}
+	})
+}
+
+func FuzzData(f *testing.F) {
+	f.Add([]byte("hello"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(DataAttribute, data)
+
+		if len(data) <= maxFuzzLen {
+			reread(t, NewRequest(Binding|Indication), NewDataAttr(data))
+		}
+	})
+}
+
+func FuzzRequestedTransport(f *testing.F) {
+	f.Add([]byte{TransportUDP, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzValue(RequestedTransport, data)
+
+		p := byte(fuzzUint(data) >> 56)
+		if got := reread(t, NewRequest(Binding|Request), NewRequestedTransport(p)).(*RequestedTransportAttr).Protocol(); got != p {
+			t.Fatalf("protocol %d decoded as %d", p, got)
+		}
+	})
+}
+
+// Every registered attribute type needs a Fuzz function above
+var fuzzedTypes = []TLVType{
+	MappedAddress, XORMappedAddress, XORPeerAddress, XORRelayedAddress,
+	AlternateServer, ResponseOrigin, OtherAddress, ErrorCode, UnknownTLVTypes,
+	Username, Realm, Software, Nonce, MessageIntegrity, MessageIntegritySHA256,
+	FingerPrint, ChangeRequest, Padding, ResponsePort, Priority, UseCandidate,
+	IceControlled, IceControlling, PasswordAlgorithm, PasswordAlgorithms,
+	UserHash, ChannelNumber, Lifetime, DataAttribute, RequestedTransport,
+}
+
+func TestEveryAttributeFuzzed(t *testing.T) {
+
+	fuzzed := map[TLVType]bool{}
+	for _, typ := range fuzzedTypes {
+		fuzzed[typ] = true
+	}
+
+	for typ := range tlvTypeToFunc {
+		if !fuzzed[typ] {
+			t.Errorf("%s has no fuzz target", typeName(typ))
+		}
+	}
+}
+
+func typeName(t TLVType) string {
+	return (&TLVBase{t, nil}).TypeString()
+}
@@ -0,0 +1,129 @@
+package msg
+
+import (
+	"errors"
+	"net"
+)
+
+// Typed access to common attributes.  Unlike asserting on what Attribute
+// returns, these never panic on a message that has the wrong thing.
+
+var errWrongType = errors.New("Attribute has an unexpected type")
+
+// Decodes the value in place, so the returned IP is the only allocation
+func (this *Message) xorAddress(t TLVType) (net.UDPAddr, error) {
+
+	v, ok := this.value(t)
+	if !ok {
+		return net.UDPAddr{}, errors.New("Message not found")
+	} else if len(v) < 4 {
+		return net.UDPAddr{}, errors.New("Address attribute too short")
+	}
+
+	ip, err := DecodeIP(v[1], v[4:], this.header)
+	if err != nil {
+		return net.UDPAddr{}, err
+	}
+	return net.UDPAddr{IP: ip, Port: xorPort(v)}, nil
+}
+
+// Whether the message has an attribute of type t, which unlike Attribute
+// allocates nothing
+func (this *Message) Has(t TLVType) bool {
+	_, ok := this.value(t)
+	return ok
+}
+
+// The value of the first attribute of type t, without typing it
+func (this *Message) value(t TLVType) ([]byte, bool) {
+	for _, a := range this.attr {
+		if a.Type() == t {
+			return a.Value(), true
+		}
+	}
+	return nil, false
+}
+
+func (this *Message) XORMappedAddress() (net.UDPAddr, error) {
+	return this.xorAddress(XORMappedAddress)
+}
+
+func (this *Message) XORPeerAddress() (net.UDPAddr, error) {
+	return this.xorAddress(XORPeerAddress)
+}
+
+func (this *Message) XORRelayedAddress() (net.UDPAddr, error) {
+	return this.xorAddress(XORRelayedAddress)
+}
+
+func (this *Message) MappedAddress() (net.UDPAddr, error) {
+	return this.addr(MappedAddress)
+}
+
+func (this *Message) AlternateServer() (net.UDPAddr, error) {
+	return this.addr(AlternateServer)
+}
+
+// An attribute encoded like MAPPED-ADDRESS
+func (this *Message) addr(t TLVType) (net.UDPAddr, error) {
+
+	a, err := this.Attribute(t)
+	if err != nil {
+		return net.UDPAddr{}, err
+	}
+
+	ip, port, err := DecodeAddr(a.Value())
+	if err != nil {
+		return net.UDPAddr{}, err
+	}
+	return net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// The code and reason of the ERROR-CODE attribute
+func (this *Message) ErrorCode() (StunErrorCode, string, error) {
+
+	a, err := this.Attribute(ErrorCode)
+	if err != nil {
+		return 0, "", err
+	}
+
+	e, ok := a.(*StunError)
+	if !ok {
+		return 0, "", errWrongType
+	}
+
+	code, err := e.Code()
+	if err != nil {
+		return 0, "", err
+	}
+	return code, e.ErrorString(), nil
+}
+
+func (this *Message) Username() (string, bool) {
+	return this.stringAttr(Username)
+}
+
+func (this *Message) Realm() (string, bool) {
+	return this.stringAttr(Realm)
+}
+
+func (this *Message) Software() (string, bool) {
+	return this.stringAttr(Software)
+}
+
+func (this *Message) Nonce() (*NonceAttr, bool) {
+	a, err := this.Attribute(Nonce)
+	if err != nil {
+		return nil, false
+	}
+	n, ok := a.(*NonceAttr)
+	return n, ok
+}
+
+func (this *Message) stringAttr(t TLVType) (string, bool) {
+	a, err := this.Attribute(t)
+	if err != nil {
+		return "", false
+	}
+	return a.ValueToString(), true
+}
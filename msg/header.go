@@ -3,9 +3,8 @@ package msg
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
+	"fmt"
 	"io"
-	"log"
 	"math/rand"
 	"strconv"
 )
@@ -58,6 +57,8 @@ type Header struct {
 	length  uint16 // size of msg in bytes, not including header
 	// MagicCookie
 	id []byte
+	// RFC 3489 header, id is 16 bytes and there is no magic cookie
+	legacy bool
 }
 
 func NewHeader(msgType MessageType, length uint16) *Header {
@@ -66,53 +67,69 @@ func NewHeader(msgType MessageType, length uint16) *Header {
 		binary.BigEndian.PutUint32(id[i*4:(i+1)*4], uint32(rand.Int31()))
 	}
 
-	return &Header{msgType, length, id}
+	return &Header{msgType, length, id, false}
 }
 
 func DecodeHeader(conn io.Reader) (*Header, error) {
+	return decodeHeader(conn, false)
+}
+
+// Like DecodeHeader but also accepts RFC 3489 headers, which have no magic
+// cookie.  Those are returned with Legacy() set.
+func DecodeLegacyHeader(conn io.Reader) (*Header, error) {
+	return decodeHeader(conn, true)
+}
+
+func decodeHeader(conn io.Reader, allowLegacy bool) (*Header, error) {
 
-	buf, err := Read(conn, 20)
+	buf, err := readFull(conn, 20, false)
 	if err != nil {
 		return nil, err
 	}
 
-	// Make sure magic cookie is in the right place
-	if buf[4] == MagicCookie[0] && buf[5] == MagicCookie[1] &&
-		buf[6] == MagicCookie[2] && buf[7] == MagicCookie[3] {
-
-		var msgType uint16 = 0
-		err := binary.Read(bytes.NewBuffer(buf[0:2]), binary.BigEndian, &msgType)
-		if err != nil {
-			return nil, err
-		}
+	header := &Header{}
+	if err := header.unmarshal(buf, allowLegacy); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
 
-		var length uint16 = 0
-		err = binary.Read(bytes.NewBuffer(buf[2:4]), binary.BigEndian, &length)
-		if err != nil {
-			return nil, err
-		}
+// Decodes the first 20 bytes of buf into the header, which keeps referring to
+// buf for its transaction id
+func (this *Header) unmarshal(buf []byte, allowLegacy bool) error {
 
-		header := &Header{MessageType(msgType), length, buf[8:20]}
+	if len(buf) < 20 {
+		return ErrTruncated
+	}
 
-		// Check that first to bits are 0s
-		if header.msgType > 16383 {
+	// Make sure magic cookie is in the right place
+	legacy := !bytes.Equal(buf[4:8], MagicCookie)
+	if legacy && !allowLegacy {
+		return ErrBadCookie
+	}
 
-			return nil, errors.New("Bad message type")
-		}
+	this.msgType = MessageType(binary.BigEndian.Uint16(buf[0:2]))
+	this.length = binary.BigEndian.Uint16(buf[2:4])
+	this.id = buf[8:20:20]
+	this.legacy = legacy
+	if legacy {
+		this.id = buf[4:20:20]
+	}
 
-		if header.length%4 != 0 {
-			return nil, errors.New("Message length not a multiple of 4")
-		}
+	// Check that first to bits are 0s
+	if this.msgType > 16383 {
+		return ErrBadType
+	}
 
-		return header, nil
+	if this.length%4 != 0 {
+		return ErrUnaligned
+	}
 
-	} else {
-		log.Println(buf, MagicCookie)
-		return nil, errors.New("Magic cookie is inedible")
+	if 20+int(this.length) > MaxMessageSize {
+		return ErrTooLarge
 	}
 
-	log.Println("Go 1.1 makes it so I don't have to do this")
-	return nil, nil
+	return nil
 }
 
 func (this *Header) Type() MessageType {
@@ -121,23 +138,24 @@ func (this *Header) Type() MessageType {
 
 func (this *Header) TypeString() string {
 	ret := ""
-	if v, contains := classTypeToString[this.msgType & ClassMask]; contains {
-		ret += v + " "
-	} else {
-		panic("Message type has no class")
-	}
+	ret += classTypeToString[this.msgType & ClassMask] + " "
 
+	// Decoded messages may have any method
 	if v, contains := methodTypeToString[this.msgType & MethodMask]; contains {
 		ret += v
 	} else {
-		panic("Message type has no method")
+		ret += fmt.Sprintf("Unknown 0x%03X", uint16(this.msgType & MethodMask))
 	}
 
 	return ret
 }
 
 func (this *Header) Copy() *Header {
-	return &Header{this.msgType, this.length, this.id}
+	return &Header{this.msgType, this.length, this.id, this.legacy}
+}
+
+func (this *Header) Legacy() bool {
+	return this.legacy
 }
 
 func (this *Header) SetLength(length uint16) {
@@ -149,21 +167,18 @@ func (this *Header) TransactionId() []byte {
 }
 
 func (this *Header) Data() []byte {
+	return this.appendTo(make([]byte, 0, 20))
+}
 
-	ret := make([]byte, 0, 20)
-
-	msg := []byte{0, 0}
-	binary.BigEndian.PutUint16(msg, uint16(this.msgType))
-	ret = append(ret, msg...)
-
-	l := []byte{0, 0}
-	binary.BigEndian.PutUint16(l, this.length)
-	ret = append(ret, l...)
+func (this *Header) appendTo(dst []byte) []byte {
 
-	ret = append(ret, MagicCookie...)
-	ret = append(ret, this.id...)
+	dst = append(dst, byte(this.msgType>>8), byte(this.msgType))
+	dst = append(dst, byte(this.length>>8), byte(this.length))
 
-	return ret
+	if !this.legacy {
+		dst = append(dst, MagicCookie...)
+	}
+	return append(dst, this.id...)
 }
 
 func (this *Header) String() string {
@@ -0,0 +1,89 @@
+package msg
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// ICE connectivity check attributes, RFC 8445 section 16.1
+const Priority TLVType = 0x0024
+const UseCandidate TLVType = 0x0025
+const IceControlled TLVType = 0x8029
+const IceControlling TLVType = 0x802A
+
+func init() {
+	p := func(t TLVType, b []byte) TLV { return &PriorityAttr{NewTLV(t, b)} }
+	u := func(t TLVType, b []byte) TLV { return &UseCandidateAttr{NewTLV(t, b)} }
+	r := func(t TLVType, b []byte) TLV { return &IceRoleAttr{NewTLV(t, b)} }
+
+	RegisterAttributeType(Priority, "Priority", p)
+	RegisterAttributeType(UseCandidate, "Use Candidate", u)
+	RegisterAttributeType(IceControlled, "ICE Controlled", r)
+	RegisterAttributeType(IceControlling, "ICE Controlling", r)
+}
+
+type PriorityAttr struct {
+	TLV
+}
+
+func NewPriority(priority uint32) *PriorityAttr {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, priority)
+	return &PriorityAttr{&TLVBase{Priority, v}}
+}
+
+func (this *PriorityAttr) Priority() uint32 {
+	v := this.Value()
+	if len(v) != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+func (this *PriorityAttr) String() string {
+	return this.TypeString() + " :\t" + strconv.FormatUint(uint64(this.Priority()), 10)
+}
+
+// Sent by the controlling agent to nominate a pair, it has no value
+type UseCandidateAttr struct {
+	TLV
+}
+
+func NewUseCandidate() *UseCandidateAttr {
+	return &UseCandidateAttr{&TLVBase{UseCandidate, []byte{}}}
+}
+
+// ICE-CONTROLLED or ICE-CONTROLLING, both carry the agent's tie breaker
+type IceRoleAttr struct {
+	TLV
+}
+
+func NewIceControlled(tieBreaker uint64) *IceRoleAttr {
+	return newIceRole(IceControlled, tieBreaker)
+}
+
+func NewIceControlling(tieBreaker uint64) *IceRoleAttr {
+	return newIceRole(IceControlling, tieBreaker)
+}
+
+func newIceRole(t TLVType, tieBreaker uint64) *IceRoleAttr {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, tieBreaker)
+	return &IceRoleAttr{&TLVBase{t, v}}
+}
+
+func (this *IceRoleAttr) Controlling() bool {
+	return this.Type() == IceControlling
+}
+
+func (this *IceRoleAttr) TieBreaker() uint64 {
+	v := this.Value()
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func (this *IceRoleAttr) String() string {
+	return this.TypeString() + " :\t" + strconv.FormatUint(this.TieBreaker(), 10)
+}
@@ -0,0 +1,78 @@
+package msg
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+func init() {
+	m := func(t TLVType, b []byte) TLV { return &MappedAddressAttr{NewTLV(t, b)} }
+	RegisterAttributeType(MappedAddress, "Mapped Address", m)
+}
+
+// MAPPED-ADDRESS, the only address attribute RFC 3489 clients understand
+type MappedAddressAttr struct {
+	TLV
+}
+
+func NewMappedAddress(ip net.IP, port int) *MappedAddressAttr {
+	return &MappedAddressAttr{&TLVBase{MappedAddress, AddrBytes(ip, port)}}
+}
+
+// Encodes an address the way MAPPED-ADDRESS does: a zero byte, the family,
+// the port and then the address, none of it obfuscated
+func AddrBytes(ip net.IP, port int) []byte {
+
+	value := []byte{0, FamilyIPv4, 0, 0}
+	binary.BigEndian.PutUint16(value[2:4], uint16(port))
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return append(value, ip4...)
+	}
+
+	// Anything that is not a valid address is sent as ::
+	ip = ip.To16()
+	if ip == nil {
+		ip = net.IPv6unspecified
+	}
+	value[1] = FamilyIPv6
+	return append(value, ip...)
+}
+
+func DecodeAddr(v []byte) (net.IP, int, error) {
+
+	if len(v) < 4 {
+		return nil, 0, errors.New("Address attribute too short")
+	}
+
+	port := int(binary.BigEndian.Uint16(v[2:4]))
+	ip := v[4:]
+
+	switch v[1] {
+	case FamilyIPv4:
+		if len(ip) != net.IPv4len {
+			return nil, 0, errors.New("IPv4 address must be 4 bytes")
+		}
+	case FamilyIPv6:
+		if len(ip) != net.IPv6len {
+			return nil, 0, errors.New("IPv6 address must be 16 bytes")
+		}
+	default:
+		return nil, 0, errors.New("Unknown address family")
+	}
+
+	ret := make(net.IP, len(ip))
+	copy(ret, ip)
+	return ret, port, nil
+}
+
+func (this *MappedAddressAttr) IP() (net.IP, error) {
+	ip, _, err := DecodeAddr(this.Value())
+	return ip, err
+}
+
+func (this *MappedAddressAttr) Port() int {
+	_, port, _ := DecodeAddr(this.Value())
+	return port
+}
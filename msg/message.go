@@ -1,59 +1,183 @@
 package msg
 
 import (
+	"encoding/binary"
 	"errors"
 	"io"
-	"log"
 )
 
 type Message struct {
 	header *Header
 	attr   []TLV
+	raw    []byte // bytes the message was decoded from, nil if built locally
+
+	// Backs attr for decoded messages and attributes added with AddXORAddress,
+	// kept so decoding or building again reuses it
+	decoded []TLVBase
+	values  []byte
+
+	// Backs header and its transaction id when the message made them
+	head Header
+	id   [16]byte
 }
 
 func NewRequest(msgType MessageType) *Message {
-	return &Message{NewHeader(msgType, 0), []TLV{}}
+	return &Message{header: NewHeader(msgType, 0), attr: []TLV{}}
 }
 
 // msgType should only include a class.  The method will be taken from
 // the req.
 func NewResponse(msgType MessageType, req *Message) *Message {
-	t := req.Header().Type() & MethodMask | msgType & ClassMask
-	header := &Header{t, 0, req.header.id}
-	return &Message{header, []TLV{}}
+	res := &Message{}
+	res.InitResponse(msgType, req)
+	return res
+}
+
+// Makes the message a response to req as NewResponse does, reusing its
+// storage, so answering with the same Message again allocates nothing.
+// Attributes taken from the message before are overwritten.
+func (this *Message) InitResponse(msgType MessageType, req *Message) {
+
+	t := req.Header().Type()&MethodMask | msgType&ClassMask
+	id := append(this.id[:0], req.header.id...)
+	this.head = Header{t, 0, id, req.header.legacy}
+
+	this.header = &this.head
+	this.attr = this.attr[:0]
+	this.raw = nil
+	this.decoded = this.decoded[:0]
+	this.values = this.values[:0]
 }
 
 func DecodeMessage(conn io.Reader) (*Message, error) {
+	return decodeMessage(conn, false)
+}
+
+// Like DecodeMessage but also accepts RFC 3489 messages
+func DecodeLegacyMessage(conn io.Reader) (*Message, error) {
+	return decodeMessage(conn, true)
+}
+
+// Reads a whole message from conn before decoding it, never trusting the
+// header length further than the bytes actually read
+func decodeMessage(conn io.Reader, allowLegacy bool) (*Message, error) {
 
-	header, err := DecodeHeader(conn)
+	header, err := readFull(conn, 20, false)
 	if err != nil {
 		return nil, err
 	}
-	
-	tvl := []TLV{}
-	for i := uint16(0); i < header.length; {
-		if t, padding, err := Decode(conn); err != nil {
-			log.Println(err)
-			return nil, err
-		} else {
-			tvl = append(tvl, t)
-			i += t.Length() + uint16(padding)
-			if (t.Length() + uint16(padding)) % 4 != 0 {
-				log.Println(t.TypeString(), "is not 4 byte aligned")
-				return nil, errors.New(t.TypeString() + " not 4 byte aligned")
+
+	h := &Header{}
+	if err := h.unmarshal(header, allowLegacy); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 20+int(h.length))
+	copy(data, header)
+	if _, err := io.ReadFull(conn, data[20:]); err == io.ErrUnexpectedEOF || err == io.EOF {
+		return nil, ErrTruncated
+	} else if err != nil {
+		return nil, err
+	}
+
+	m := &Message{}
+	if err := m.unmarshal(data, allowLegacy); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Decodes data in place.  The message refers to data rather than copying it,
+// so data must not change while the message is in use.  Storage is reused,
+// so decoding into the same Message again allocates nothing, but attributes
+// taken from the message before are overwritten.  Errors are the sentinels
+// in errors.go.
+func (this *Message) UnmarshalBinary(data []byte) error {
+	return this.unmarshal(data, false)
+}
+
+// Like UnmarshalBinary but also accepts RFC 3489 messages
+func (this *Message) UnmarshalLegacy(data []byte) error {
+	return this.unmarshal(data, true)
+}
+
+func (this *Message) unmarshal(data []byte, allowLegacy bool) error {
+
+	if this.header == nil {
+		this.header = &this.head
+	}
+	if err := this.header.unmarshal(data, allowLegacy); err != nil {
+		return err
+	}
+
+	end := 20 + int(this.header.length)
+	if len(data) < end {
+		return ErrTruncated
+	}
+	data = data[:end:end]
+
+	this.decoded = this.decoded[:0]
+	for offset := 20; offset < end; {
+		t, v, size, err := parseAttr(data[offset:])
+		if err != nil {
+			return err
+		}
+
+		if t == FingerPrint {
+			if offset+size != end {
+				return ErrFingerprintPosition
+			}
+			if len(v) != 4 || binary.BigEndian.Uint32(v) != Fingerprint(data[:offset]) {
+				return ErrFingerprintMismatch
 			}
-		} 
+		}
+
+		this.decoded = append(this.decoded, TLVBase{t, v})
+		offset += size
+	}
+
+	this.attr = this.attr[:0]
+	for i := range this.decoded {
+		this.attr = append(this.attr, &this.decoded[i])
 	}
+	this.raw = data
+	return nil
+}
+
+// Bytes an attribute takes up in a message, its type and length then the
+// value padded to a 4 byte block
+func attrSize(tlv TLV) uint16 {
+	return 4 + ((tlv.Length() +3 ) / 4) * 4
+}
 
-	return &Message{header, tvl}, err
+// Offset of the first attribute of type t from the start of the message
+func (this *Message) offset(t TLVType) (int, bool) {
+	offset := 20
+	for _, a := range this.attr {
+		if a.Type() == t {
+			return offset, true
+		}
+		offset += int(attrSize(a))
+	}
+	return 0, false
 }
 
 func (this *Message) EncodeMessage() []byte {
-	ret := this.header.Data()
+	return this.AppendTo(make([]byte, 0, 20+int(this.header.length)))
+}
+
+// Appends the encoded message to dst, which allocates nothing when dst has
+// room for it
+func (this *Message) AppendTo(dst []byte) []byte {
+	dst = this.header.appendTo(dst)
 	for _, a := range this.attr {
-		ret = append(ret, a.Encode()...)
+		dst = appendAttr(dst, a)
 	}
-	return ret
+	return dst
+}
+
+func (this *Message) MarshalBinary() ([]byte, error) {
+	return this.EncodeMessage(), nil
 }
 
 func (this *Message) Type() MessageType {
@@ -69,7 +193,7 @@ func (this *Message) AddAttribute(tlv TLV) {
 	inserted := false
 	for i, a := range this.attr {
 		if tlv.Type() == a.Type() {
-			this.header.length -= ((a.Length() +3 ) / 4) * 4
+			this.header.length -= attrSize(a)
 			this.attr[i] = tlv
 			inserted = true
 			break
@@ -80,16 +204,57 @@ func (this *Message) AddAttribute(tlv TLV) {
 		this.attr = append(this.attr, tlv)
 	}
 
-	// make sure it is on a 4 byte block
-	this.header.length += ((tlv.Length() +3 ) / 4) * 4
+	this.header.length += attrSize(tlv)
 }
 
 func (this *Message) AddDupAttribute(tlv TLV) {
 
 	this.attr = append(this.attr, tlv)
 
-	// make sure it is on a 4 byte block
-	this.header.length += ((tlv.Length() +3 ) / 4) * 4
+	this.header.length += attrSize(tlv)
+}
+
+func (this *Message) RemoveAttribute(t TLVType) {
+
+	attrs := this.attr[:0]
+	for _, a := range this.attr {
+		if a.Type() == t {
+			this.header.length -= attrSize(a)
+		} else {
+			attrs = append(attrs, a)
+		}
+	}
+	this.attr = attrs
+}
+
+// Appends a FINGERPRINT attribute covering everything before it.  Nothing
+// should be added to the message afterwards.
+func (this *Message) AddFingerprint() {
+
+	this.RemoveAttribute(FingerPrint)
+
+	start := len(this.values)
+	this.values = append(this.values, 0, 0, 0, 0)
+	fp := this.store(FingerPrint, start)
+	this.AddDupAttribute(fp)
+
+	// The message is encoded after the values, so the storage is reused
+	n := len(this.values)
+	data := this.header.appendTo(this.values)
+	for _, a := range this.attr[:len(this.attr)-1] {
+		data = appendAttr(data, a)
+	}
+	this.values = data[:n]
+
+	binary.BigEndian.PutUint32(fp.value, Fingerprint(data[n:]))
+}
+
+// Makes an attribute of the values appended to this.values from start, held
+// in the message's own storage
+func (this *Message) store(t TLVType, start int) *TLVBase {
+	end := len(this.values)
+	this.decoded = append(this.decoded, TLVBase{t, this.values[start:end:end]})
+	return &this.decoded[len(this.decoded)-1]
 }
 
 func (this *Message) CopyAttributes(other *Message) {
@@ -106,7 +271,7 @@ func (this *Message) CopyAttributes(other *Message) {
 func (this *Message) Attribute(t TLVType) (TLV, error) {
 	for _, a := range this.attr {
 		if a.Type() == t {
-			return a, nil
+			return typed(a), nil
 		}
 	}
 	return nil, errors.New("Message not found")
@@ -116,7 +281,29 @@ func (this *Message) Attributes(t TLVType) []TLV {
 	ret := []TLV{}
 	for _, a := range this.attr {
 		if a.Type() == t {
-			ret = append(ret, a)
+			ret = append(ret, typed(a))
+		}
+	}
+	return ret
+}
+
+// Types of the comprehension-required attributes that are not registered,
+// each listed once.  Requests with any must be answered with a 420.
+func (this *Message) UnknownRequired() []TLVType {
+
+	ret := []TLVType{}
+	for _, a := range this.attr {
+		t := a.Type()
+		if !t.Required() || KnownAttributeType(t) {
+			continue
+		}
+
+		seen := false
+		for _, u := range ret {
+			seen = seen || u == t
+		}
+		if !seen {
+			ret = append(ret, t)
 		}
 	}
 	return ret
@@ -125,7 +312,7 @@ func (this *Message) Attributes(t TLVType) []TLV {
 func (this *Message) String() string {
 	ret := this.header.String()
 	for _, a := range this.attr {
-		ret += "\n" + a.String()
+		ret += "\n" + typed(a).String()
 	}
 	return ret
 }
@@ -0,0 +1,225 @@
+package msg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+var benchIP = net.IPv4(192, 0, 2, 1)
+
+// A Binding request as a client sends it, with SOFTWARE and FINGERPRINT
+func bindingRequest() []byte {
+	req := NewRequest(Binding | Request)
+	s, _ := NewSoftware("bench")
+	req.AddAttribute(s)
+	req.AddFingerprint()
+	return req.EncodeMessage()
+}
+
+// What a server does for each Binding request, reusing req, res and buf
+func answerBinding(req, res *Message, data, buf []byte) []byte {
+	if req.UnmarshalBinary(data) != nil {
+		return nil
+	}
+	res.InitResponse(Success, req)
+	res.AddXORAddress(XORMappedAddress, benchIP, 4242)
+	res.AddFingerprint()
+	return res.AppendTo(buf[:0])
+}
+
+func TestInitResponse(t *testing.T) {
+
+	req := &Message{}
+	if err := req.UnmarshalBinary(bindingRequest()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ip := range []net.IP{benchIP, net.ParseIP("2001:db8::1")} {
+		res := &Message{}
+		res.InitResponse(Success, req)
+		res.AddXORAddress(XORMappedAddress, ip, 4242)
+
+		want := NewResponse(Success, req)
+		want.AddAttribute(NewXORAddress(ip, 4242, want.Header()))
+		if !bytes.Equal(res.EncodeMessage(), want.EncodeMessage()) {
+			t.Errorf("%v: encodings differ", ip)
+		}
+
+		addr, err := res.XORMappedAddress()
+		if err != nil || !addr.IP.Equal(ip) || addr.Port != 4242 {
+			t.Errorf("%v: got %v, %v", ip, addr, err)
+		}
+	}
+}
+
+// The id of a response must not change when the request's buffer does
+func TestInitResponseCopiesId(t *testing.T) {
+
+	data := bindingRequest()
+	req, res := &Message{}, &Message{}
+	req.UnmarshalBinary(data)
+	res.InitResponse(Success, req)
+
+	id := append([]byte{}, res.Header().TransactionId()...)
+	data[8] ^= 0xFF
+	if !bytes.Equal(res.Header().TransactionId(), id) {
+		t.Fatal("response id refers to the request's buffer")
+	}
+}
+
+func TestAddFingerprint(t *testing.T) {
+
+	res := NewResponse(Success, NewRequest(Binding|Request))
+	res.AddXORAddress(XORMappedAddress, benchIP, 4242)
+	res.AddFingerprint()
+	res.AddFingerprint()
+
+	data := res.EncodeMessage()
+	prefix := data[:len(data)-8]
+	fp, err := res.Attribute(FingerPrint)
+	if err != nil || !fp.(*FingerprintAttr).Valid(prefix) {
+		t.Fatal("bad fingerprint")
+	}
+	if len(res.Attributes(FingerPrint)) != 1 {
+		t.Fatal("fingerprint added twice")
+	}
+	if err := (&Message{}).UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBindingAllocations(t *testing.T) {
+
+	data := bindingRequest()
+	req, res := &Message{}, &Message{}
+	buf := make([]byte, 0, MaxMessageSize)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		answerBinding(req, res, data, buf)
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocations per Binding response", allocs)
+	}
+
+	out := answerBinding(req, res, data, buf)
+	if err := req.UnmarshalBinary(out); err != nil {
+		t.Fatal(err)
+	}
+	allocs = testing.AllocsPerRun(100, func() {
+		req.XORMappedAddress()
+	})
+	if allocs > 1 {
+		t.Fatalf("%v allocations reading XOR-MAPPED-ADDRESS", allocs)
+	}
+}
+
+func BenchmarkUnmarshalBinary(b *testing.B) {
+	data := bindingRequest()
+	m := &Message{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := m.UnmarshalBinary(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Only a stream that ends part way is ErrTruncated, other read errors are
+// returned as they are
+func TestDecodeMessageErrors(t *testing.T) {
+
+	data := bindingRequest()
+	if _, err := DecodeMessage(bytes.NewReader(nil)); err != io.EOF {
+		t.Errorf("empty stream got %v, want io.EOF", err)
+	}
+	if _, err := DecodeMessage(bytes.NewReader(data[:len(data)-4])); err != ErrTruncated {
+		t.Errorf("short body got %v, want ErrTruncated", err)
+	}
+	if _, err := DecodeMessage(bytes.NewReader(data[:20])); err != ErrTruncated {
+		t.Errorf("missing body got %v, want ErrTruncated", err)
+	}
+
+	fail := errors.New("Read failed")
+	in := io.MultiReader(bytes.NewReader(data[:24]), iotest.ErrReader(fail))
+	if _, err := DecodeMessage(in); err != fail {
+		t.Errorf("failed read got %v, want %v", err, fail)
+	}
+}
+
+func BenchmarkDecodeMessage(b *testing.B) {
+	data := bindingRequest()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeMessage(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNewResponse(b *testing.B) {
+	req := &Message{}
+	req.UnmarshalBinary(bindingRequest())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		res := NewResponse(Success, req)
+		res.AddAttribute(NewXORAddress(benchIP, 4242, res.Header()))
+	}
+}
+
+func BenchmarkInitResponse(b *testing.B) {
+	req, res := &Message{}, &Message{}
+	req.UnmarshalBinary(bindingRequest())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		res.InitResponse(Success, req)
+		res.AddXORAddress(XORMappedAddress, benchIP, 4242)
+	}
+}
+
+func BenchmarkEncodeMessage(b *testing.B) {
+	req := &Message{}
+	req.UnmarshalBinary(bindingRequest())
+	res := NewResponse(Success, req)
+	res.AddXORAddress(XORMappedAddress, benchIP, 4242)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		res.EncodeMessage()
+	}
+}
+
+func BenchmarkAppendTo(b *testing.B) {
+	req := &Message{}
+	req.UnmarshalBinary(bindingRequest())
+	res := NewResponse(Success, req)
+	res.AddXORAddress(XORMappedAddress, benchIP, 4242)
+	buf := make([]byte, 0, MaxMessageSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = res.AppendTo(buf[:0])
+	}
+}
+
+func BenchmarkBindingResponse(b *testing.B) {
+	data := bindingRequest()
+	req, res := &Message{}, &Message{}
+	buf := make([]byte, 0, MaxMessageSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		answerBinding(req, res, data, buf)
+	}
+}
+
+func BenchmarkXORMappedAddress(b *testing.B) {
+	res := &Message{}
+	res.UnmarshalBinary(answerBinding(&Message{}, &Message{}, bindingRequest(), nil))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := res.XORMappedAddress(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package msg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// How long nonces from a NonceSigner stay valid
+const NonceLifetime = 20 * time.Minute
+
+// Size of the truncated HMAC in a signed nonce
+const nonceMACSize = 16
+
+// Length of the base64 expiry and HMAC that end a signed nonce
+var nonceBodySize = base64.RawURLEncoding.EncodedLen(8 + nonceMACSize)
+
+// Issues nonces that need no server state to check.  Each one carries its
+// expiry and an HMAC of the whole nonce and the client's IP keyed with a
+// secret, so it cannot be forged, extended or have its security features
+// changed, is only accepted from the client it was issued to, and is accepted
+// by any server sharing the secret.
+type NonceSigner struct {
+	secret   []byte
+	lifetime time.Duration
+}
+
+func NewNonceSigner(secret []byte) *NonceSigner {
+	return &NonceSigner{secret, NonceLifetime}
+}
+
+// Changes how long nonces issued from now on stay valid
+func (this *NonceSigner) SetLifetime(lifetime time.Duration) {
+	this.lifetime = lifetime
+}
+
+// The expiry and IP are a fixed size, so the variable length prefix cannot be
+// shifted into them
+func (this *NonceSigner) mac(prefix, expires []byte, ip net.IP) []byte {
+	mac := hmac.New(sha256.New, this.secret)
+	mac.Write(prefix)
+	mac.Write(expires)
+	mac.Write(ip.To16())
+	return mac.Sum(nil)[:nonceMACSize]
+}
+
+// A nonce for a client at ip, advertising features
+func (this *NonceSigner) Nonce(ip net.IP, features SecurityFeatures) *NonceAttr {
+
+	expires := make([]byte, 8)
+	binary.BigEndian.PutUint64(expires, uint64(time.Now().Add(this.lifetime).Unix()))
+
+	prefix := featurePrefix(features)
+	body := append(expires, this.mac(prefix, expires, ip)...)
+	v := append(prefix, base64.RawURLEncoding.EncodeToString(body)...)
+
+	return &NonceAttr{&TLVBase{Nonce, v}}
+}
+
+// True if t was issued by a signer with the same secret to a client at ip,
+// unchanged, and has not expired
+func (this *NonceSigner) Valid(t TLV, ip net.IP) bool {
+
+	v := t.Value()
+	if len(v) < nonceBodySize {
+		return false
+	}
+	prefix := v[:len(v)-nonceBodySize]
+
+	body, err := base64.RawURLEncoding.DecodeString(string(v[len(prefix):]))
+	if err != nil || len(body) != 8+nonceMACSize {
+		return false
+	}
+
+	expires, sum := body[:8], body[8:]
+	if subtle.ConstantTimeCompare(sum, this.mac(prefix, expires, ip)) != 1 {
+		return false
+	}
+
+	return time.Unix(int64(binary.BigEndian.Uint64(expires)), 0).After(time.Now())
+}
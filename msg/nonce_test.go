@@ -0,0 +1,66 @@
+package msg
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNonceSigner(t *testing.T) {
+
+	ip := net.IPv4(192, 0, 2, 1)
+	signer := NewNonceSigner([]byte("secret"))
+	n := signer.Nonce(ip, FeaturePasswordAlgorithms)
+
+	if !signer.Valid(n, ip) {
+		t.Error("issued nonce is not valid")
+	}
+	if n.Features() != FeaturePasswordAlgorithms {
+		t.Errorf("features %x", n.Features())
+	}
+	if !NewNonceSigner([]byte("secret")).Valid(n, ip) {
+		t.Error("nonce is not valid for a signer sharing the secret")
+	}
+	if NewNonceSigner([]byte("other")).Valid(n, ip) {
+		t.Error("nonce is valid for a signer with another secret")
+	}
+	if signer.Valid(n, net.IPv4(192, 0, 2, 2)) {
+		t.Error("nonce is valid from another address")
+	}
+
+	expired := NewNonceSigner([]byte("secret"))
+	expired.SetLifetime(-time.Second)
+	if expired.Valid(expired.Nonce(ip, 0), ip) {
+		t.Error("expired nonce is valid")
+	}
+}
+
+// Security features are what stop downgrades, so changing them must make the
+// nonce invalid
+func TestNonceFeaturesSigned(t *testing.T) {
+
+	ip := net.IPv4(192, 0, 2, 1)
+	signer := NewNonceSigner([]byte("secret"))
+	n := signer.Nonce(ip, FeaturePasswordAlgorithms|FeatureUsernameAnonymity)
+	body := n.Value()[len(featurePrefix(n.Features())):]
+
+	for name, prefix := range map[string][]byte{
+		"stripped": featurePrefix(0),
+		"changed":  featurePrefix(FeatureUsernameAnonymity),
+		"added":    featurePrefix(FeaturePasswordAlgorithms | FeatureUsernameAnonymity | 1),
+	} {
+		tampered := &NonceAttr{&TLVBase{Nonce, append(append([]byte{}, prefix...), body...)}}
+		if signer.Valid(tampered, ip) {
+			t.Errorf("nonce with features %s is valid", name)
+		}
+	}
+
+	v := append([]byte{}, n.Value()...)
+	v[len(v)-1] ^= 1
+	if signer.Valid(&NonceAttr{&TLVBase{Nonce, v}}, ip) {
+		t.Error("nonce with a changed HMAC is valid")
+	}
+	if signer.Valid(&NonceAttr{&TLVBase{Nonce, v[:10]}}, ip) {
+		t.Error("truncated nonce is valid")
+	}
+}
@@ -0,0 +1,136 @@
+package msg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+)
+
+// RFC 8489 attributes for choosing how the long term key is derived
+const MessageIntegritySHA256 TLVType = 0x001C
+const PasswordAlgorithm TLVType = 0x001D
+const PasswordAlgorithms TLVType = 0x8002
+
+type PasswordAlgorithmID uint16
+
+const AlgorithmMD5 PasswordAlgorithmID = 0x0001
+const AlgorithmSHA256 PasswordAlgorithmID = 0x0002
+
+func init() {
+	m := func(t TLVType, b []byte) TLV { return &IntegritySHA256Attr{NewTLV(t, b)} }
+	a := func(t TLVType, b []byte) TLV { return &PasswordAlgorithmAttr{NewTLV(t, b)} }
+	as := func(t TLVType, b []byte) TLV { return &PasswordAlgorithmsAttr{NewTLV(t, b)} }
+
+	RegisterAttributeType(MessageIntegritySHA256, "Message Integrity SHA256", m)
+	RegisterAttributeType(PasswordAlgorithm, "Password Algorithm", a)
+	RegisterAttributeType(PasswordAlgorithms, "Password Algorithms", as)
+}
+
+// Long term key for alg, RFC 8489 section 9.2.2.  Unknown algorithms get MD5,
+// which is what a server without PASSWORD-ALGORITHMS expects.
+func PasswordKey(alg PasswordAlgorithmID, user, realm, passwd string) []byte {
+
+	if alg != AlgorithmSHA256 {
+		return LongTermKey(user, realm, passwd)
+	}
+
+	hash := sha256.New()
+	io.WriteString(hash, user+":"+realm+":"+passwd)
+	return hash.Sum(nil)
+}
+
+// A password algorithm with no parameters, which is all RFC 8489 defines
+func algorithmBytes(alg PasswordAlgorithmID) []byte {
+	v := []byte{0, 0, 0, 0}
+	binary.BigEndian.PutUint16(v, uint16(alg))
+	return v
+}
+
+type PasswordAlgorithmAttr struct {
+	TLV
+}
+
+func NewPasswordAlgorithm(alg PasswordAlgorithmID) *PasswordAlgorithmAttr {
+	return &PasswordAlgorithmAttr{&TLVBase{PasswordAlgorithm, algorithmBytes(alg)}}
+}
+
+func (this *PasswordAlgorithmAttr) Algorithm() PasswordAlgorithmID {
+	v := this.Value()
+	if len(v) < 4 {
+		return 0
+	}
+	return PasswordAlgorithmID(binary.BigEndian.Uint16(v[0:2]))
+}
+
+// The algorithms a server accepts, most preferred first
+type PasswordAlgorithmsAttr struct {
+	TLV
+}
+
+func NewPasswordAlgorithms(algs ...PasswordAlgorithmID) *PasswordAlgorithmsAttr {
+	v := []byte{}
+	for _, alg := range algs {
+		v = append(v, algorithmBytes(alg)...)
+	}
+	return &PasswordAlgorithmsAttr{&TLVBase{PasswordAlgorithms, v}}
+}
+
+func (this *PasswordAlgorithmsAttr) Algorithms() []PasswordAlgorithmID {
+
+	ret := []PasswordAlgorithmID{}
+	v := this.Value()
+	for len(v) >= 4 {
+		alg := binary.BigEndian.Uint16(v[0:2])
+		params := int(binary.BigEndian.Uint16(v[2:4]))
+		params = (params + 3) / 4 * 4
+		if len(v) < 4+params {
+			break
+		}
+
+		ret = append(ret, PasswordAlgorithmID(alg))
+		v = v[4+params:]
+	}
+	return ret
+}
+
+func (this *PasswordAlgorithmsAttr) Contains(alg PasswordAlgorithmID) bool {
+	for _, a := range this.Algorithms() {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+type IntegritySHA256Attr struct {
+	TLV
+}
+
+func NewIntegritySHA256(key []byte, msg *Message) *IntegritySHA256Attr {
+	return &IntegritySHA256Attr{&TLVBase{MessageIntegritySHA256, CreateHMACSHA256(key, msg)}}
+}
+
+// HMAC-SHA256 of the message, RFC 8489 section 14.6
+func CreateHMACSHA256(key []byte, msg *Message) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(integrityInput(msg, MessageIntegritySHA256, sha256.Size))
+	return mac.Sum(nil)
+}
+
+// Senders may truncate the HMAC to as little as 16 bytes, so only as much as
+// was sent is compared
+func (this *IntegritySHA256Attr) ValidKey(key []byte, msg *Message) bool {
+
+	h1 := this.Value()
+	if len(h1) < 16 || len(h1) > sha256.Size || len(h1)%4 != 0 {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(integrityInput(msg, MessageIntegritySHA256, len(h1)))
+	h2 := mac.Sum(nil)[:len(h1)]
+
+	return subtle.ConstantTimeCompare(h1, h2) == 1
+}
@@ -0,0 +1,111 @@
+package msg
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestPasswordKey(t *testing.T) {
+
+	md5Key := md5.Sum([]byte("user:realm:pass"))
+	if !bytes.Equal(PasswordKey(AlgorithmMD5, "user", "realm", "pass"), md5Key[:]) {
+		t.Error("MD5 key is not MD5(username:realm:password)")
+	}
+
+	shaKey := sha256.Sum256([]byte("user:realm:pass"))
+	if !bytes.Equal(PasswordKey(AlgorithmSHA256, "user", "realm", "pass"), shaKey[:]) {
+		t.Error("SHA-256 key is not SHA-256(username:realm:password)")
+	}
+}
+
+// A request signed with MESSAGE-INTEGRITY-SHA256, as decoded by its receiver
+func signedSHA256(t *testing.T, key []byte) (*Message, *IntegritySHA256Attr) {
+
+	m := NewRequest(Binding | Request)
+	u, _ := NewUser("user")
+	m.AddAttribute(u)
+	m.AddAttribute(NewIntegritySHA256(key, m))
+
+	decoded := &Message{}
+	if err := decoded.UnmarshalBinary(m.EncodeMessage()); err != nil {
+		t.Fatal(err)
+	}
+	i, err := decoded.Attribute(MessageIntegritySHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded, i.(*IntegritySHA256Attr)
+}
+
+func TestIntegritySHA256(t *testing.T) {
+
+	key := PasswordKey(AlgorithmSHA256, "user", "realm", "pass")
+	m, i := signedSHA256(t, key)
+
+	if len(i.Value()) != sha256.Size {
+		t.Errorf("HMAC is %d bytes", len(i.Value()))
+	}
+	if !i.ValidKey(key, m) {
+		t.Error("MESSAGE-INTEGRITY-SHA256 does not validate")
+	}
+	if i.ValidKey(PasswordKey(AlgorithmSHA256, "user", "realm", "wrong"), m) {
+		t.Error("MESSAGE-INTEGRITY-SHA256 validates with the wrong key")
+	}
+
+	// Anything covered by the HMAC changes it
+	raw := append([]byte{}, m.raw...)
+	raw[len(raw)-sha256.Size-5] ^= 1
+	tampered := &Message{}
+	if err := tampered.UnmarshalBinary(raw); err != nil {
+		t.Fatal(err)
+	}
+	if i.ValidKey(key, tampered) {
+		t.Error("MESSAGE-INTEGRITY-SHA256 validates a changed message")
+	}
+}
+
+// RFC 8489 section 14.6 lets senders truncate the HMAC to 16 bytes or more,
+// in multiples of 4
+func TestIntegritySHA256Truncated(t *testing.T) {
+
+	key := []byte("key")
+	for _, size := range []int{12, 16, 20, 28, 30} {
+		m := NewRequest(Binding | Request)
+		mac := hmac.New(sha256.New, key)
+		mac.Write(integrityInput(m, MessageIntegritySHA256, size))
+		m.AddAttribute(&IntegritySHA256Attr{&TLVBase{MessageIntegritySHA256, mac.Sum(nil)[:size]}})
+
+		decoded := &Message{}
+		if err := decoded.UnmarshalBinary(m.EncodeMessage()); err != nil {
+			t.Fatal(err)
+		}
+		i, _ := decoded.Attribute(MessageIntegritySHA256)
+
+		want := size >= 16 && size%4 == 0
+		if got := i.(*IntegritySHA256Attr).ValidKey(key, decoded); got != want {
+			t.Errorf("%d byte HMAC valid: %v, want %v", size, got, want)
+		}
+	}
+}
+
+func TestPasswordAlgorithms(t *testing.T) {
+
+	as := NewPasswordAlgorithms(AlgorithmSHA256, AlgorithmMD5)
+
+	// Each algorithm has no parameters, RFC 8489 section 14.11
+	want := []byte{0, 2, 0, 0, 0, 1, 0, 0}
+	if !bytes.Equal(as.Value(), want) {
+		t.Errorf("value %x, want %x", as.Value(), want)
+	}
+
+	algs := as.Algorithms()
+	if len(algs) != 2 || algs[0] != AlgorithmSHA256 || algs[1] != AlgorithmMD5 {
+		t.Errorf("algorithms %v", algs)
+	}
+	if as.Contains(3) {
+		t.Error("contains an algorithm it was not given")
+	}
+}
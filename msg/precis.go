@@ -0,0 +1,143 @@
+package msg
+
+import (
+	"errors"
+	"golang.org/x/text/secure/precis"
+	"golang.org/x/text/unicode/bidi"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+)
+
+// Prepares a username with the RFC 8265 UsernameCasePreserved profile, so
+// equivalent Unicode spellings give the same key on both sides.  Usernames
+// with spaces are prepared a userpart at a time, RFC 8265 section 3.5.  The
+// empty username of an unauthenticated client is left as it is.
+func PrepareUsername(user string) (string, error) {
+
+	if user == "" {
+		return "", nil
+	}
+
+	parts := strings.Split(user, " ")
+	for i, part := range parts {
+		p, err := precis.UsernameCasePreserved.String(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = p
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// Prepares a password or realm with the RFC 8265 OpaqueString profile.
+// Strings it rejects but RFC 5389's SASLprep accepts, such as the password of
+// RFC 5769 section 2.4, are prepared with SASLprep instead.  Empty strings are
+// left as they are.
+func PrepareOpaque(s string) (string, error) {
+
+	if s == "" {
+		return "", nil
+	}
+
+	if p, err := precis.OpaqueString.String(s); err == nil {
+		return p, nil
+	}
+	return saslPrep(s)
+}
+
+var errProhibited = errors.New("SASLprep: prohibited character")
+var errBidi = errors.New("SASLprep: bad bidirectional string")
+
+// RFC 4013, for stored strings unassigned code points are not checked
+func saslPrep(s string) (string, error) {
+
+	mapped := make([]rune, 0, len(s))
+	for _, r := range s {
+		if mappedToNothing(r) {
+			continue
+		} else if nonASCIISpace(r) {
+			r = ' '
+		}
+		mapped = append(mapped, r)
+	}
+
+	s = norm.NFKC.String(string(mapped))
+
+	randAL, l := false, false
+	for _, r := range s {
+		if prohibited(r) {
+			return "", errProhibited
+		}
+
+		p, _ := bidi.LookupRune(r)
+		switch p.Class() {
+		case bidi.R, bidi.AL:
+			randAL = true
+		case bidi.L:
+			l = true
+		}
+	}
+
+	// RFC 3454 section 6
+	if randAL {
+		rs := []rune(s)
+		first, _ := bidi.LookupRune(rs[0])
+		last, _ := bidi.LookupRune(rs[len(rs)-1])
+		if l || !isRandAL(first.Class()) || !isRandAL(last.Class()) {
+			return "", errBidi
+		}
+	}
+
+	if s == "" {
+		return "", errors.New("SASLprep: empty string")
+	}
+	return s, nil
+}
+
+func isRandAL(c bidi.Class) bool {
+	return c == bidi.R || c == bidi.AL
+}
+
+// RFC 3454 table B.1
+func mappedToNothing(r rune) bool {
+	switch {
+	case r == 0x00AD, r == 0x034F, r == 0x1806, r >= 0x180B && r <= 0x180D,
+		r >= 0x200B && r <= 0x200D, r == 0x2060, r >= 0xFE00 && r <= 0xFE0F,
+		r == 0xFEFF:
+		return true
+	}
+	return false
+}
+
+// RFC 3454 table C.1.2
+func nonASCIISpace(r rune) bool {
+	switch {
+	case r == 0x00A0, r == 0x1680, r >= 0x2000 && r <= 0x200B, r == 0x202F,
+		r == 0x205F, r == 0x3000:
+		return true
+	}
+	return false
+}
+
+// RFC 3454 tables C.1.2 to C.9, as listed by RFC 4013 section 2.3
+func prohibited(r rune) bool {
+	switch {
+	case nonASCIISpace(r):
+	case r < 0x20, r >= 0x7F && r <= 0x9F: // C.2.1 and C.2.2
+	case r == 0x06DD, r == 0x070F, r == 0x180E, r == 0x200C, r == 0x200D,
+		r == 0x2028, r == 0x2029, r >= 0x2060 && r <= 0x2063,
+		r >= 0x206A && r <= 0x206F, r == 0xFEFF, r >= 0x1D173 && r <= 0x1D17A:
+	case unicode.Is(unicode.Co, r): // C.3
+	case r >= 0xFDD0 && r <= 0xFDEF, r&0xFFFE == 0xFFFE: // C.4
+	case r >= 0xD800 && r <= 0xDFFF: // C.5
+	case r >= 0xFFF9 && r <= 0xFFFD: // C.6
+	case r >= 0x2FF0 && r <= 0x2FFB: // C.7
+	case r == 0x0340, r == 0x0341, r == 0x200E, r == 0x200F,
+		r >= 0x202A && r <= 0x202E: // C.8
+	case r == 0xE0001, r >= 0xE0020 && r <= 0xE007F: // C.9
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package msg
+
+import (
+	"testing"
+)
+
+// Examples from RFC 8265 sections 3.5 and 4.3
+func TestPrepareUsername(t *testing.T) {
+
+	valid := map[string]string{
+		"juliet@example.com": "juliet@example.com",
+		"fussball":           "fussball",
+		"fußball":            "fußball",
+		"π":                  "π",
+		"Σ":                  "Σ",
+		"σ":                  "σ",
+		"ς":                  "ς",
+		"foo bar":            "foo bar",
+		"\uFF4A\uFF55\uFF4C": "jul", // fullwidth is mapped to its decomposition
+		"":                   "",
+	}
+	for in, want := range valid {
+		got, err := PrepareUsername(in)
+		if err != nil || got != want {
+			t.Errorf("PrepareUsername(%+q) = %+q, %v, want %+q", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"henry\u2163", "♚", "foo\tbar"} {
+		if got, err := PrepareUsername(in); err == nil {
+			t.Errorf("PrepareUsername(%+q) = %+q, want an error", in, got)
+		}
+	}
+}
+
+func TestPrepareOpaque(t *testing.T) {
+
+	valid := map[string]string{
+		"correct horse battery staple": "correct horse battery staple",
+		"Correct Horse Battery Staple": "Correct Horse Battery Staple",
+		"πßå":                          "πßå",
+		"Jack of ♦s":                   "Jack of ♦s",
+		"foo\u1680bar":                 "foo bar",
+		"":                             "",
+		// RFC 5769 section 2.4, only SASLprep accepts it
+		"The\u00ADM\u00AAtr\u2168": "TheMatrIX",
+	}
+	for in, want := range valid {
+		got, err := PrepareOpaque(in)
+		if err != nil || got != want {
+			t.Errorf("PrepareOpaque(%+q) = %+q, %v, want %+q", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"my cat is a \u0009by", "\u0007"} {
+		if got, err := PrepareOpaque(in); err == nil {
+			t.Errorf("PrepareOpaque(%+q) = %+q, want an error", in, got)
+		}
+	}
+}
+
+// Examples from RFC 4013 section 3
+func TestSASLprep(t *testing.T) {
+
+	valid := map[string]string{
+		"I\u00ADX": "IX",
+		"user":     "user",
+		"USER":     "USER",
+		"\u00AA":   "a",
+		"\u2168":   "IX",
+	}
+	for in, want := range valid {
+		got, err := saslPrep(in)
+		if err != nil || got != want {
+			t.Errorf("saslPrep(%+q) = %+q, %v, want %+q", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"\u0007", "\u06271", "\u00AD"} {
+		if got, err := saslPrep(in); err == nil {
+			t.Errorf("saslPrep(%+q) = %+q, want an error", in, got)
+		}
+	}
+}
+
+func TestEmptyCredentials(t *testing.T) {
+
+	if _, err := NewUser(""); err != nil {
+		t.Error("NewUser:", err)
+	}
+	if _, err := NewRealm(""); err != nil {
+		t.Error("NewRealm:", err)
+	}
+}
@@ -0,0 +1,34 @@
+package msg
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+func init() {
+	s := func(t TLVType, b []byte) TLV { return &SoftwareAttr{NewTLV(t, b)} }
+	RegisterAttributeType(Software, "Software", s)
+}
+
+// A description of the agent sending the message, such as its name and
+// version, RFC 5389 section 15.10
+type SoftwareAttr struct {
+	TLV
+}
+
+func NewSoftware(description string) (*SoftwareAttr, error) {
+
+	if utf8.RuneCountInString(description) > 127 || len(description) > 763 {
+		return nil, errors.New("Software must be under 128 characters")
+	}
+
+	return &SoftwareAttr{&TLVBase{Software, []byte(description)}}, nil
+}
+
+func (this *SoftwareAttr) Description() string {
+	return this.ValueToString()
+}
+
+func (this *SoftwareAttr) String() string {
+	return this.TypeString() + " :\t" + this.Description()
+}
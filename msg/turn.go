@@ -0,0 +1,122 @@
+package msg
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// TURN methods, RFC 5766 section 13
+const (
+	Allocate         MessageType = 0x0003
+	Refresh          MessageType = 0x0004
+	Send             MessageType = 0x0006
+	Data             MessageType = 0x0007
+	CreatePermission MessageType = 0x0008
+	ChannelBind      MessageType = 0x0009
+)
+
+// TURN attributes, RFC 5766 section 14
+const ChannelNumber TLVType = 0x000C
+const Lifetime TLVType = 0x000D
+const XORPeerAddress TLVType = 0x0012
+const DataAttribute TLVType = 0x0013
+const XORRelayedAddress TLVType = 0x0016
+const RequestedTransport TLVType = 0x0019
+
+// IANA protocol number carried in REQUESTED-TRANSPORT
+const TransportUDP byte = 17
+
+func init() {
+	RegisterMethodType(Allocate, "Allocate")
+	RegisterMethodType(Refresh, "Refresh")
+	RegisterMethodType(Send, "Send")
+	RegisterMethodType(Data, "Data")
+	RegisterMethodType(CreatePermission, "Create Permission")
+	RegisterMethodType(ChannelBind, "Channel Bind")
+
+	c := func(t TLVType, b []byte) TLV { return &ChannelNumberAttr{NewTLV(t, b)} }
+	l := func(t TLVType, b []byte) TLV { return &LifetimeAttr{NewTLV(t, b)} }
+	x := func(t TLVType, b []byte) TLV { return &XORAddress{NewTLV(t, b)} }
+	d := func(t TLVType, b []byte) TLV { return &DataAttr{NewTLV(t, b)} }
+	r := func(t TLVType, b []byte) TLV { return &RequestedTransportAttr{NewTLV(t, b)} }
+
+	RegisterAttributeType(ChannelNumber, "Channel Number", c)
+	RegisterAttributeType(Lifetime, "Lifetime", l)
+	RegisterAttributeType(XORPeerAddress, "XOR Peer Address", x)
+	RegisterAttributeType(DataAttribute, "Data", d)
+	RegisterAttributeType(XORRelayedAddress, "XOR Relayed Address", x)
+	RegisterAttributeType(RequestedTransport, "Requested Transport", r)
+}
+
+func NewXORPeerAddress(ip net.IP, port int, h *Header) *XORAddress {
+	return &XORAddress{&TLVBase{XORPeerAddress, XORAddrBytes(ip, port, h)}}
+}
+
+func NewXORRelayedAddress(ip net.IP, port int, h *Header) *XORAddress {
+	return &XORAddress{&TLVBase{XORRelayedAddress, XORAddrBytes(ip, port, h)}}
+}
+
+type ChannelNumberAttr struct {
+	TLV
+}
+
+func NewChannelNumber(channel uint16) *ChannelNumberAttr {
+	v := []byte{0, 0, 0, 0}
+	binary.BigEndian.PutUint16(v, channel)
+	return &ChannelNumberAttr{&TLVBase{ChannelNumber, v}}
+}
+
+func (this *ChannelNumberAttr) Channel() uint16 {
+	v := this.Value()
+	if len(v) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(v[0:2])
+}
+
+type LifetimeAttr struct {
+	TLV
+}
+
+func NewLifetime(d time.Duration) *LifetimeAttr {
+	v := []byte{0, 0, 0, 0}
+	binary.BigEndian.PutUint32(v, uint32(d/time.Second))
+	return &LifetimeAttr{&TLVBase{Lifetime, v}}
+}
+
+func (this *LifetimeAttr) Lifetime() time.Duration {
+	v := this.Value()
+	if len(v) != 4 {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+}
+
+func (this *LifetimeAttr) String() string {
+	return this.TypeString() + " :\t" + this.Lifetime().String()
+}
+
+type DataAttr struct {
+	TLV
+}
+
+func NewDataAttr(data []byte) *DataAttr {
+	return &DataAttr{&TLVBase{DataAttribute, data}}
+}
+
+type RequestedTransportAttr struct {
+	TLV
+}
+
+func NewRequestedTransport(protocol byte) *RequestedTransportAttr {
+	return &RequestedTransportAttr{&TLVBase{RequestedTransport, []byte{protocol, 0, 0, 0}}}
+}
+
+func (this *RequestedTransportAttr) Protocol() byte {
+	v := this.Value()
+	if len(v) != 4 {
+		return 0
+	}
+	return v[0]
+}
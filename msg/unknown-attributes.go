@@ -0,0 +1,36 @@
+package msg
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Lists the comprehension-required attributes that caused a 420
+type UnknownAttributesAttr struct {
+	TLV
+}
+
+func NewUnknownAttributes(types []TLVType) *UnknownAttributesAttr {
+	v := make([]byte, 2*len(types))
+	for i, t := range types {
+		binary.BigEndian.PutUint16(v[2*i:], uint16(t))
+	}
+	return &UnknownAttributesAttr{&TLVBase{UnknownTLVTypes, v}}
+}
+
+func (this *UnknownAttributesAttr) Types() []TLVType {
+	v := this.Value()
+	ret := make([]TLVType, 0, len(v)/2)
+	for i := 0; i+2 <= len(v); i += 2 {
+		ret = append(ret, TLVType(binary.BigEndian.Uint16(v[i:])))
+	}
+	return ret
+}
+
+func (this *UnknownAttributesAttr) String() string {
+	ret := this.TypeString() + " :"
+	for _, t := range this.Types() {
+		ret += fmt.Sprintf("\t0x%04X", uint16(t))
+	}
+	return ret
+}
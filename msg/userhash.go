@@ -0,0 +1,37 @@
+package msg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Sent instead of USERNAME when the server's nonce advertises username
+// anonymity, RFC 8489 section 14.4
+const UserHash TLVType = 0x001E
+
+func init() {
+	h := func(t TLVType, b []byte) TLV { return &UserHashAttr{NewTLV(t, b)} }
+	RegisterAttributeType(UserHash, "User Hash", h)
+}
+
+type UserHashAttr struct {
+	TLV
+}
+
+func NewUserHash(user, realm string) *UserHashAttr {
+	return &UserHashAttr{&TLVBase{UserHash, HashUser(user, realm)}}
+}
+
+// SHA-256(username:realm), what a USERHASH carries for user
+func HashUser(user, realm string) []byte {
+	sum := sha256.Sum256([]byte(user + ":" + realm))
+	return sum[:]
+}
+
+func (this *UserHashAttr) Hash() []byte {
+	return this.Value()
+}
+
+func (this *UserHashAttr) String() string {
+	return this.TypeString() + " :\t" + hex.EncodeToString(this.Value())
+}
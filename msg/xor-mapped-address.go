@@ -1,8 +1,8 @@
 package msg
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"net"
 )
 
@@ -21,72 +21,101 @@ func NewXORAddress(ip net.IP, port int, h *Header) *XORAddress {
 	return &XORAddress{&TLVBase{XORMappedAddress, XORAddrBytes(ip, port, h)}}
 }
 
+// Address families, RFC 5389 section 15.1
+const FamilyIPv4 byte = 0x01
+const FamilyIPv6 byte = 0x02
+
 func XORAddrBytes(ip net.IP, port int, header *Header) []byte {
+	return appendXORAddr(make([]byte, 0, 4+net.IPv6len), ip, port, header)
+}
 
-	// RFC 5389
-	// 0x01:IPv4
-	// 0x02:IPv6
-	family := []byte{0, 1}
+// Appends the value of an XOR-MAPPED-ADDRESS style attribute to dst
+func appendXORAddr(dst []byte, ip net.IP, port int, header *Header) []byte {
 
-	xip := ip.To4()
-	if xip != nil {
-		ret := make([]byte, net.IPv4len)
-		copy(ret, xip)
-		for i := 0; i < net.IPv4len; i++ {
-			ret[i] = xip[i] ^ MagicCookie[i]
-		}
-		xip = ret
-	} else {
-		ret := make([]byte, net.IPv6len)
+	xport := uint16(port) ^ binary.BigEndian.Uint16(MagicCookie)
+
+	if ip4 := ip.To4(); ip4 != nil {
+		dst = append(dst, 0, FamilyIPv4, byte(xport>>8), byte(xport))
 		for i := 0; i < net.IPv4len; i++ {
-			ret[i] = ip[i] ^ MagicCookie[i]
-		}
-		for i := 4; i < net.IPv6len; i++ {
-			ret[i] = ip[i] ^ header.id[i-4]
+			dst = append(dst, ip4[i]^MagicCookie[i])
 		}
-		family[1] = 2
-		xip = ret
+		return dst
 	}
 
-	xport := []byte{0, 0}
-	binary.BigEndian.PutUint16(xport, uint16(port))
-	for i := 0; i < 2; i++ {
-		xport[i] = xport[i] ^ MagicCookie[i]
+	// Anything that is not a valid address is sent as ::
+	ip = ip.To16()
+	if ip == nil {
+		ip = net.IPv6unspecified
+	}
+
+	// IPv6 addresses are XORed with the cookie then the transaction id
+	dst = append(dst, 0, FamilyIPv6, byte(xport>>8), byte(xport))
+	for i := 0; i < net.IPv4len; i++ {
+		dst = append(dst, ip[i]^MagicCookie[i])
 	}
+	for i := net.IPv4len; i < net.IPv6len; i++ {
+		dst = append(dst, ip[i]^header.id[i-net.IPv4len])
+	}
+	return dst
+}
+
+// Adds an attribute of type t encoded like XOR-MAPPED-ADDRESS.  Unlike
+// adding NewXORAddress, the value is kept in the message's own storage, so
+// this allocates nothing once the message has been reused.
+func (this *Message) AddXORAddress(t TLVType, ip net.IP, port int) {
 
-	value := family
-	value = append(value, xport...)
-	value = append(value, xip...)
-	return value
+	start := len(this.values)
+	this.values = appendXORAddr(this.values, ip, port, this.header)
+	this.AddAttribute(this.store(t, start))
 }
 
-func DecodeIP(family byte, ip []byte, header *Header) net.IP {
+func DecodeIP(family byte, ip []byte, header *Header) (net.IP, error) {
 
-	v := make([]byte, len(ip))
-	if family == 1 {
+	switch family {
+	case FamilyIPv4:
+		if len(ip) != net.IPv4len {
+			return nil, errors.New("IPv4 address must be 4 bytes")
+		}
+
+		v := make(net.IP, net.IPv4len)
 		for i := 0; i < net.IPv4len; i++ {
 			v[i] = ip[i] ^ MagicCookie[i]
 		}
-		return v
-	} else {
+		return v, nil
+
+	case FamilyIPv6:
+		if len(ip) != net.IPv6len {
+			return nil, errors.New("IPv6 address must be 16 bytes")
+		}
+		if len(header.id) != 12 {
+			return nil, errors.New("IPv6 address needs a 12 byte transaction id")
+		}
+
+		v := make(net.IP, net.IPv6len)
 		for i := 0; i < net.IPv4len; i++ {
 			v[i] = ip[i] ^ MagicCookie[i]
 		}
-		for i := 4; i < 16; i++ {
-			v[i] = ip[i] ^ header.id[i-4]
+		for i := net.IPv4len; i < net.IPv6len; i++ {
+			v[i] = ip[i] ^ header.id[i-net.IPv4len]
 		}
-		return v
+		return v, nil
 	}
 
-	return nil
+	return nil, errors.New("Unknown address family")
 }
 
-func (this *XORAddress) IP(header *Header) net.IP {
+func (this *XORAddress) IP(header *Header) (net.IP, error) {
 	v := this.Value()
+	if len(v) < 4 {
+		return nil, errors.New("Address attribute too short")
+	}
 	return DecodeIP(v[1], v[4:], header)
 }
 
 func DecodePort(p []byte) []byte {
+	if len(p) < 2 {
+		return []byte{0, 0}
+	}
 	v := make([]byte, len(p))
 	for i := 0; i < 2; i++ {
 		v[i] = p[i] ^ MagicCookie[i]
@@ -95,13 +124,20 @@ func DecodePort(p []byte) []byte {
 }
 
 func (this *XORAddress) PortByteArray() []byte {
-	return DecodePort(this.Value()[2:4])
+	v := this.Value()
+	if len(v) < 4 {
+		return []byte{0, 0}
+	}
+	return DecodePort(v[2:4])
 }
 
 func (this *XORAddress) Port() int {
-	p := this.PortByteArray()
+	return xorPort(this.Value())
+}
 
-	var port uint16 = 0
-	binary.Read(bytes.NewBuffer(p), binary.BigEndian, &port)
-	return int(port)
+func xorPort(v []byte) int {
+	if len(v) < 4 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(v[2:4]) ^ binary.BigEndian.Uint16(MagicCookie))
 }
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bytes"
+	"github.com/ricochet2200/gun/msg"
+	"net"
+	"testing"
+	"time"
+)
+
+type testAuth map[string]string
+
+func (this testAuth) Password(user string) (string, bool) {
+	p, ok := this[user]
+	return p, ok
+}
+
+// Passes req to s as if it arrived over UDP and returns the response
+func exchange(t *testing.T, s *Server, req *msg.Message) *msg.Message {
+
+	srv, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	cli, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	s.handlePacket(srv, &packet{data: req.EncodeMessage(), addr: cli.LocalAddr()})
+
+	buf := make([]byte, MaxPacketSize)
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := cli.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("no response:", err)
+	}
+
+	res := &msg.Message{}
+	if err := res.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func errorCode(t *testing.T, res *msg.Message) msg.StunErrorCode {
+	code, _, err := res.ErrorCode()
+	if err != nil {
+		return 0
+	}
+	return code
+}
+
+func newTestServer() *Server {
+	return NewServer(0, make(chan *Connection, 10), testAuth{"user": "pass"})
+}
+
+// The 401 answering an unsigned request
+func challengeFor(t *testing.T, s *Server) *msg.Message {
+
+	res := exchange(t, s, msg.NewRequest(msg.Binding|msg.Request))
+	if code := errorCode(t, res); code != msg.Unauthorized {
+		t.Fatalf("unsigned request answered with %d", code)
+	}
+	return res
+}
+
+// A Binding request answering challenge, choosing alg from algs, signed
+// with MESSAGE-INTEGRITY-SHA256 when alg is SHA-256
+func signedRequest(t *testing.T, challenge *msg.Message, alg msg.PasswordAlgorithmID, algs *msg.PasswordAlgorithmsAttr) *msg.Message {
+
+	realm, _ := challenge.Realm()
+	nonce, _ := challenge.Nonce()
+
+	req := msg.NewRequest(msg.Binding | msg.Request)
+	u, _ := msg.NewUser("user")
+	r, _ := msg.NewRealm(realm)
+	req.AddAttribute(u)
+	req.AddAttribute(r)
+	req.AddAttribute(nonce)
+
+	key := msg.PasswordKey(alg, "user", realm, "pass")
+	if algs != nil {
+		req.AddAttribute(msg.NewPasswordAlgorithm(alg))
+		req.AddAttribute(algs)
+	}
+	if alg == msg.AlgorithmSHA256 {
+		req.AddAttribute(msg.NewIntegritySHA256(key, req))
+	} else {
+		req.AddAttribute(msg.NewIntegrityAttrKey(key, req))
+	}
+	return req
+}
+
+func TestChallengeOffersAlgorithms(t *testing.T) {
+
+	res := challengeFor(t, newTestServer())
+
+	nonce, ok := res.Nonce()
+	if !ok || nonce.Features()&msg.FeaturePasswordAlgorithms == 0 {
+		t.Fatal("nonce does not advertise password algorithms")
+	}
+
+	as, err := res.Attribute(msg.PasswordAlgorithms)
+	if err != nil {
+		t.Fatal("challenge without PASSWORD-ALGORITHMS")
+	}
+	algs := as.(*msg.PasswordAlgorithmsAttr).Algorithms()
+	if len(algs) != 2 || algs[0] != msg.AlgorithmSHA256 || algs[1] != msg.AlgorithmMD5 {
+		t.Errorf("offered %v", algs)
+	}
+}
+
+func TestSHA256Negotiation(t *testing.T) {
+
+	s := newTestServer()
+	challenge := challengeFor(t, s)
+	offered := msg.NewPasswordAlgorithms(PasswordAlgorithms...)
+
+	res := exchange(t, s, signedRequest(t, challenge, msg.AlgorithmSHA256, offered))
+	if res.Type() != msg.Binding|msg.Success {
+		t.Fatalf("SHA-256 request answered with %d", errorCode(t, res))
+	}
+
+	// Answered with the integrity and key the request used
+	i, err := res.Attribute(msg.MessageIntegritySHA256)
+	if err != nil {
+		t.Fatal("response without MESSAGE-INTEGRITY-SHA256")
+	}
+	realm, _ := challenge.Realm()
+	key := msg.PasswordKey(msg.AlgorithmSHA256, "user", realm, "pass")
+	if !i.(*msg.IntegritySHA256Attr).ValidKey(key, res) {
+		t.Error("response MESSAGE-INTEGRITY-SHA256 does not validate")
+	}
+	if _, err := res.Attribute(msg.MessageIntegrity); err == nil {
+		t.Error("response also carries MESSAGE-INTEGRITY")
+	}
+}
+
+func TestMD5FromOffer(t *testing.T) {
+
+	s := newTestServer()
+	challenge := challengeFor(t, s)
+	offered := msg.NewPasswordAlgorithms(PasswordAlgorithms...)
+
+	res := exchange(t, s, signedRequest(t, challenge, msg.AlgorithmMD5, offered))
+	if res.Type() != msg.Binding|msg.Success {
+		t.Fatalf("MD5 request answered with %d", errorCode(t, res))
+	}
+
+	i, err := res.Attribute(msg.MessageIntegrity)
+	realm, _ := challenge.Realm()
+	if err != nil || !msg.ToIntegrity(i).ValidKey(msg.PasswordKey(msg.AlgorithmMD5, "user", realm, "pass"), res) {
+		t.Error("response MESSAGE-INTEGRITY does not validate")
+	}
+}
+
+// RFC 8489 section 9.2.5, every way of forcing a weaker algorithm is a 400
+func TestDowngradeRejected(t *testing.T) {
+
+	s := newTestServer()
+	challenge := challengeFor(t, s)
+
+	tests := map[string]*msg.Message{
+		"algorithms stripped": signedRequest(t, challenge, msg.AlgorithmMD5, nil),
+		"list changed": signedRequest(t, challenge, msg.AlgorithmMD5,
+			msg.NewPasswordAlgorithms(msg.AlgorithmMD5)),
+		"algorithm not offered": signedRequest(t, challenge, 3,
+			msg.NewPasswordAlgorithms(PasswordAlgorithms...)),
+	}
+
+	for name, req := range tests {
+		if code := errorCode(t, exchange(t, s, req)); code != msg.BadRequest {
+			t.Errorf("%s: answered with %d, want 400", name, code)
+		}
+	}
+
+	// PASSWORD-ALGORITHM without the list
+	req := signedRequest(t, challenge, msg.AlgorithmSHA256, msg.NewPasswordAlgorithms(PasswordAlgorithms...))
+	req.RemoveAttribute(msg.PasswordAlgorithms)
+	req.RemoveAttribute(msg.MessageIntegritySHA256)
+	realm, _ := challenge.Realm()
+	req.AddAttribute(msg.NewIntegritySHA256(msg.PasswordKey(msg.AlgorithmSHA256, "user", realm, "pass"), req))
+	if code := errorCode(t, exchange(t, s, req)); code != msg.BadRequest {
+		t.Errorf("missing list: answered with %d, want 400", code)
+	}
+}
+
+// Nonces without the feature, as from servers predating RFC 8489
+type plainNonces struct {
+	NonceManager
+}
+
+func (this plainNonces) Nonce(ip net.IP, features msg.SecurityFeatures) *msg.NonceAttr {
+	return this.NonceManager.Nonce(ip, 0)
+}
+
+func TestMD5WithoutAlgorithms(t *testing.T) {
+
+	s := newTestServer()
+	s.SetNonceManager(plainNonces{NewNonceManager([]byte("secret"), time.Minute)})
+	challenge := challengeFor(t, s)
+
+	res := exchange(t, s, signedRequest(t, challenge, msg.AlgorithmMD5, nil))
+	if res.Type() != msg.Binding|msg.Success {
+		t.Fatalf("RFC 5389 request answered with %d", errorCode(t, res))
+	}
+}
+
+// Finds users by USERHASH, RFC 8489 section 14.4
+type testHashAuth struct {
+	testAuth
+}
+
+func (this testHashAuth) UserByHash(hash []byte, realm string) (string, bool) {
+	for user := range this.testAuth {
+		if bytes.Equal(msg.HashUser(user, realm), hash) {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// A request answering challenge that names its user by USERHASH, keyed
+// with user and passwd
+func userHashRequest(t *testing.T, challenge *msg.Message, hashed, user, passwd string) *msg.Message {
+
+	realm, _ := challenge.Realm()
+	nonce, _ := challenge.Nonce()
+
+	req := msg.NewRequest(msg.Binding | msg.Request)
+	req.AddAttribute(msg.NewUserHash(hashed, realm))
+	r, _ := msg.NewRealm(realm)
+	req.AddAttribute(r)
+	req.AddAttribute(nonce)
+	req.AddAttribute(msg.NewPasswordAlgorithm(msg.AlgorithmSHA256))
+	req.AddAttribute(msg.NewPasswordAlgorithms(PasswordAlgorithms...))
+
+	key := msg.PasswordKey(msg.AlgorithmSHA256, user, realm, passwd)
+	req.AddAttribute(msg.NewIntegritySHA256(key, req))
+	return req
+}
+
+func TestUserHash(t *testing.T) {
+
+	// Knows the empty user, which an unknown hash must not fall back to
+	s := NewServer(0, make(chan *Connection, 10), testHashAuth{testAuth{"user": "pass", "": "guest"}})
+	challenge := challengeFor(t, s)
+
+	nonce, _ := challenge.Nonce()
+	if nonce.Features()&msg.FeatureUsernameAnonymity == 0 {
+		t.Fatal("nonce does not advertise username anonymity")
+	}
+
+	res := exchange(t, s, userHashRequest(t, challenge, "user", "user", "pass"))
+	if res.Type() != msg.Binding|msg.Success {
+		t.Fatalf("known USERHASH answered with %d", errorCode(t, res))
+	}
+
+	res = exchange(t, s, userHashRequest(t, challenge, "nobody", "", "guest"))
+	if code := errorCode(t, res); code != msg.Unauthorized {
+		t.Errorf("unknown USERHASH answered with %d, want 401", code)
+	}
+}
+
+// Servers that cannot look up hashes know no user by one
+func TestUserHashUnsupported(t *testing.T) {
+
+	s := newTestServer()
+	res := exchange(t, s, userHashRequest(t, challengeFor(t, s), "user", "user", "pass"))
+	if code := errorCode(t, res); code != msg.Unauthorized {
+		t.Errorf("USERHASH answered with %d, want 401", code)
+	}
+}
@@ -8,29 +8,166 @@ import (
 type Connection struct {
 	Req *msg.Message
 	Out net.Conn
+	// Set instead of Out when the request arrived as a datagram
+	Packet net.PacketConn
+	Addr   net.Addr
 	User string
 	Passwd string
 	Realm string
 	HasAuth bool
+
+	// Integrity key when it is not derived from User, Passwd and Realm, as
+	// with short term credentials
+	key []byte
+	// MessageIntegritySHA256 when the request was signed with it
+	integrity msg.TLVType
+	software  *msg.SoftwareAttr
+
+	// Set for RFC 5780 discovery, where the response may leave from a
+	// different socket and go to a different port than the request came from
+	reply   net.PacketConn
+	replyTo net.Addr
+	origin  net.Addr
+	other   net.Addr
+	padding int
+
+	// Storage reused for responses, and the datagram Req was decoded from,
+	// see packet
+	res  *msg.Message
+	out  []byte
+	data []byte
+
+	// Set once a copy is passed on, see Server.deliver
+	delivered bool
+
+	// Called with each encoded response, set by Server.Validate when
+	// responses are kept for retransmissions
+	sent func(res []byte)
+}
+
+// A copy of the Connection holding nothing of the packet it arrived in, so
+// the packet can be reused while the copy is in use
+func (this *Connection) detach() *Connection {
+
+	c := *this
+	c.res, c.out, c.sent = nil, nil, nil
+	if this.data == nil {
+		return &c
+	}
+
+	c.data = append([]byte(nil), this.data...)
+	c.Req = &msg.Message{}
+	if this.Req.Header().Legacy() {
+		c.Req.UnmarshalLegacy(c.data)
+	} else {
+		c.Req.UnmarshalBinary(c.data)
+	}
+	return &c
+}
+
+// A new response to the request, built in the Connection's own storage when
+// it has some, so only one may be in use at a time
+func (this *Connection) response(class msg.MessageType) *msg.Message {
+	if this.res == nil {
+		return msg.NewResponse(class, this.Req)
+	}
+	this.res.InitResponse(class, this.Req)
+	return this.res
+}
+
+func (this *Connection) RemoteAddr() net.Addr {
+	if this.Addr != nil {
+		return this.Addr
+	}
+	return this.Out.RemoteAddr()
 }
 
 func (this *Connection) Port() int {
-	return this.Out.RemoteAddr().(*net.TCPAddr).Port
+	_, port := addrIPPort(this.RemoteAddr())
+	return port
 }
 
 func (this *Connection) IP() net.IP {
-	return this.Out.RemoteAddr().(*net.TCPAddr).IP
+	ip, _ := addrIPPort(this.RemoteAddr())
+	return ip
 }
 
 func (this *Connection) Write(res *msg.Message) {
 
-	xorAddr := msg.NewXORAddress(this.IP(), this.Port(), res.Header())
-	res.AddAttribute(xorAddr)
-	
-	if this.HasAuth {
-		i := msg.NewIntegrityAttr(this.User, this.Passwd, this.Realm, this.Req)
-		res.AddAttribute(i)
+	if res.Header().Legacy() {
+		// RFC 3489 clients only understand MAPPED-ADDRESS
+		if res.Type()&msg.ClassMask == msg.Success {
+			res.AddAttribute(msg.NewMappedAddress(this.IP(), this.Port()))
+		}
+		this.send(res)
+		return
 	}
 
-	this.Out.Write(res.EncodeMessage())
-}
\ No newline at end of file
+	res.AddXORAddress(msg.XORMappedAddress, this.IP(), this.Port())
+
+	if this.origin != nil {
+		ip, port := addrIPPort(this.origin)
+		res.AddAttribute(msg.NewResponseOrigin(ip, port))
+
+		ip, port = addrIPPort(this.other)
+		res.AddAttribute(msg.NewOtherAddress(ip, port))
+	}
+
+	if this.software != nil {
+		res.AddAttribute(this.software)
+	}
+
+	if this.padding > 0 {
+		res.AddAttribute(msg.NewPadding(this.padding))
+	}
+
+	key := this.key
+	if key == nil && this.HasAuth {
+		key = msg.LongTermKey(this.User, this.Realm, this.Passwd)
+	}
+
+	if key != nil && this.integrity == msg.MessageIntegritySHA256 {
+		res.AddAttribute(msg.NewIntegritySHA256(key, res))
+	} else if key != nil {
+		res.AddAttribute(msg.NewIntegrityAttrKey(key, res))
+	}
+
+	// Answer in kind so peers multiplexing STUN can still pick it out
+	if this.Req.Has(msg.FingerPrint) {
+		res.AddFingerprint()
+	}
+
+	this.send(res)
+}
+
+func (this *Connection) send(res *msg.Message) {
+
+	this.out = res.AppendTo(this.out[:0])
+	if this.sent != nil {
+		this.sent(this.out)
+	}
+	this.transmit(this.out)
+}
+
+// Sends an encoded response
+func (this *Connection) transmit(b []byte) {
+	if this.reply != nil {
+		this.reply.WriteTo(b, this.replyTo)
+		return
+	}
+	if this.Packet != nil {
+		this.Packet.WriteTo(b, this.Addr)
+		return
+	}
+	this.Out.Write(b)
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"github.com/ricochet2200/gun/msg"
+	"log"
+	"net"
+	"strconv"
+)
+
+// The four sockets of an RFC 5780 server, indexed by [ip][port] where 0 is the
+// primary and 1 the alternate
+type discovery struct {
+	socks [2][2]net.PacketConn
+}
+
+// Serves RFC 5780 NAT behavior discovery over UDP.  A socket is bound for each
+// combination of the primary and alternate IPs and ports, and every Binding
+// request is answered from the one its CHANGE-REQUEST selects, with
+// RESPONSE-ORIGIN and OTHER-ADDRESS attached.  The two IPs must differ, as
+// must the two ports.
+func (this *Server) StartDiscovery(primary, alternate *net.UDPAddr) error {
+
+	ips := []net.IP{primary.IP, alternate.IP}
+	ports := []int{primary.Port, alternate.Port}
+
+	d := &discovery{}
+	for i, ip := range ips {
+		for j, port := range ports {
+			addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+			log.Println("Listening on udp", addr)
+
+			pc, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				log.Println(err)
+				d.Close()
+				return err
+			}
+			d.socks[i][j] = pc
+		}
+	}
+
+	// Closed once the server has stopped, as responses may leave from any
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			if !this.track(d.socks[i][j]) {
+				d.Close()
+				return ErrServerClosed
+			}
+		}
+	}
+
+	errc := make(chan error, 4)
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			i, j := i, j
+			go func() {
+				errc <- this.servePackets(d.socks[i][j], func(p *packet) {
+					this.handleDiscovery(d, i, j, p)
+				})
+			}()
+		}
+	}
+
+	return <-errc
+}
+
+// Has Serve also serve NAT behavior discovery, see StartDiscovery.  nil
+// addresses turn it off.
+func (this *Server) SetDiscovery(primary, alternate *net.UDPAddr) {
+	if primary == nil || alternate == nil {
+		this.discoveryAddrs = nil
+		return
+	}
+	this.discoveryAddrs = []*net.UDPAddr{primary, alternate}
+}
+
+func (this *discovery) Close() {
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			if this.socks[i][j] != nil {
+				this.socks[i][j].Close()
+			}
+		}
+	}
+}
+
+func (this *Server) handleDiscovery(d *discovery, ip, port int, p *packet) {
+
+	req, addr := &p.req, p.addr
+	if err := this.unmarshal(req, p.data); err != nil {
+		log.Println(err)
+		return
+	}
+
+	conn := p.connection(d.socks[ip][port], this.software)
+	if req.Type() != msg.Binding|msg.Request || req.Header().Legacy() {
+		this.handleRequest(conn)
+		return
+	}
+
+	// OTHER-ADDRESS is relative to where the request arrived
+	conn.other = d.socks[1-ip][1-port].LocalAddr()
+
+	if a, err := req.Attribute(msg.ChangeRequest); err == nil {
+		change := a.(*msg.ChangeRequestAttr)
+		if change.ChangeIP() {
+			ip = 1 - ip
+		}
+		if change.ChangePort() {
+			port = 1 - port
+		}
+	}
+
+	conn.reply = d.socks[ip][port]
+	conn.replyTo = addr
+	conn.origin = conn.reply.LocalAddr()
+
+	padding, pErr := req.Attribute(msg.Padding)
+	if a, err := req.Attribute(msg.ResponsePort); err == nil {
+		if pErr == nil {
+			res := msg.NewResponse(msg.Error, req)
+			e, _ := msg.NewErrorAttr(msg.BadRequest, "Padding with Response Port")
+			res.AddAttribute(e)
+
+			log.Println("Padding with Response Port")
+			conn.Write(res)
+			return
+		}
+		conn.replyTo = &net.UDPAddr{IP: conn.IP(), Port: a.(*msg.ResponsePortAttr).Port()}
+	}
+
+	if pErr == nil {
+		conn.padding = int(padding.Length())
+	}
+
+	this.handleRequest(conn)
+}
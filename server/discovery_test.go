@@ -0,0 +1,152 @@
+package server
+
+import (
+	"github.com/ricochet2200/gun/msg"
+	"net"
+	"testing"
+	"time"
+)
+
+// Starts discovery on 127.0.0.1 and 127.0.0.2 and returns one of the
+// 127.0.0.1 sockets' addresses
+func startDiscovery(t *testing.T, s *Server) *net.UDPAddr {
+
+	go s.StartDiscovery(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	t.Cleanup(func() { s.Close() })
+
+	for i := 0; i < 500; i++ {
+		s.life.lock.Lock()
+		var addr *net.UDPAddr
+		for c := range s.life.open {
+			a := c.(net.PacketConn).LocalAddr().(*net.UDPAddr)
+			if a.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+				addr = a
+			}
+		}
+		n := len(s.life.open)
+		s.life.lock.Unlock()
+
+		if n == 4 {
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("discovery sockets never opened")
+	return nil
+}
+
+func listenUDP(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+// Sends req from cli to server and returns the response read from on and
+// where it came from
+func discover(t *testing.T, cli, on net.PacketConn, server *net.UDPAddr, req *msg.Message) (*msg.Message, *net.UDPAddr) {
+
+	if _, err := cli.WriteTo(req.EncodeMessage(), server); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, MaxPacketSize)
+	on.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := on.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("no response:", err)
+	}
+
+	res := &msg.Message{}
+	if err := res.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return res, from.(*net.UDPAddr)
+}
+
+func origin(t *testing.T, res *msg.Message) *net.UDPAddr {
+	a, err := res.Attribute(msg.ResponseOrigin)
+	if err != nil {
+		t.Fatal("no RESPONSE-ORIGIN")
+	}
+	ip, _ := a.(*msg.ResponseOriginAttr).IP()
+	return &net.UDPAddr{IP: ip, Port: a.(*msg.ResponseOriginAttr).Port()}
+}
+
+func other(t *testing.T, res *msg.Message) *net.UDPAddr {
+	a, err := res.Attribute(msg.OtherAddress)
+	if err != nil {
+		t.Fatal("no OTHER-ADDRESS")
+	}
+	ip, _ := a.(*msg.OtherAddressAttr).IP()
+	return &net.UDPAddr{IP: ip, Port: a.(*msg.OtherAddressAttr).Port()}
+}
+
+func changeRequest(changeIP, changePort bool) *msg.Message {
+	req := msg.NewRequest(msg.Binding | msg.Request)
+	req.AddAttribute(msg.NewChangeRequest(changeIP, changePort))
+	return req
+}
+
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// RFC 5780 section 6, CHANGE-REQUEST picks the socket the response leaves from
+func TestDiscoveryChangeRequest(t *testing.T) {
+
+	s := NewServer(0, nil, nil)
+	primary := startDiscovery(t, s)
+	cli := listenUDP(t)
+
+	res, from := discover(t, cli, cli, primary, msg.NewRequest(msg.Binding|msg.Request))
+	if !sameUDPAddr(from, primary) || !sameUDPAddr(origin(t, res), from) {
+		t.Fatalf("answered from %v with RESPONSE-ORIGIN %v, want %v", from, origin(t, res), primary)
+	}
+	alt := other(t, res)
+	if alt.IP.Equal(primary.IP) || alt.Port == primary.Port {
+		t.Fatalf("OTHER-ADDRESS %v shares the IP or port of %v", alt, primary)
+	}
+
+	mapped, err := res.XORMappedAddress()
+	if err != nil || !sameUDPAddr(&mapped, cli.LocalAddr().(*net.UDPAddr)) {
+		t.Errorf("mapped %v, %v", mapped, err)
+	}
+
+	res, from = discover(t, cli, cli, primary, changeRequest(true, true))
+	if !sameUDPAddr(from, alt) || !sameUDPAddr(origin(t, res), from) {
+		t.Errorf("change IP and port answered from %v, want %v", from, alt)
+	}
+
+	res, from = discover(t, cli, cli, primary, changeRequest(false, true))
+	if !from.IP.Equal(primary.IP) || from.Port == primary.Port || !sameUDPAddr(origin(t, res), from) {
+		t.Errorf("change port answered from %v", from)
+	}
+
+	res, from = discover(t, cli, cli, primary, changeRequest(true, false))
+	if from.IP.Equal(primary.IP) || !sameUDPAddr(origin(t, res), from) {
+		t.Errorf("change IP answered from %v", from)
+	}
+}
+
+// RFC 5780 section 7.2 and 7.3
+func TestDiscoveryResponsePort(t *testing.T) {
+
+	s := NewServer(0, nil, nil)
+	primary := startDiscovery(t, s)
+	cli, to := listenUDP(t), listenUDP(t)
+
+	req := msg.NewRequest(msg.Binding | msg.Request)
+	req.AddAttribute(msg.NewResponsePort(to.LocalAddr().(*net.UDPAddr).Port))
+	if res, _ := discover(t, cli, to, primary, req); res.Type() != msg.Binding|msg.Success {
+		t.Errorf("got type 0x%04X", uint16(res.Type()))
+	}
+
+	req.AddAttribute(msg.NewPadding(100))
+	res, _ := discover(t, cli, cli, primary, req)
+	if code := errorCode(t, res); code != msg.BadRequest {
+		t.Errorf("RESPONSE-PORT with PADDING answered with %d, want 400", code)
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/ricochet2200/gun/msg"
+	"log"
+	"strings"
+	"sync"
+)
+
+// The local side of an ICE session, used to answer connectivity checks with
+// short term credentials as RFC 8445 section 7.3 describes
+type ICEAgent struct {
+	Ufrag    string
+	Password string
+
+	lock        sync.Mutex
+	controlling bool
+	tieBreaker  uint64
+}
+
+func NewICEAgent(ufrag, password string, controlling bool) *ICEAgent {
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return &ICEAgent{
+		Ufrag:       ufrag,
+		Password:    password,
+		controlling: controlling,
+		tieBreaker:  binary.BigEndian.Uint64(b),
+	}
+}
+
+// The agent's current role, which a role conflict can change
+func (this *ICEAgent) Controlling() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.controlling
+}
+
+func (this *ICEAgent) TieBreaker() uint64 {
+	return this.tieBreaker
+}
+
+// Resolves a conflict with the role in req, RFC 8445 section 7.3.1.1.
+// Returns false if the remote agent has to switch roles, in which case it
+// must be sent 487.
+func (this *ICEAgent) resolveRole(req *msg.Message) bool {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	t := msg.IceControlled
+	if this.controlling {
+		t = msg.IceControlling
+	}
+
+	a, err := req.Attribute(t)
+	if err != nil {
+		return true
+	}
+
+	theirs := a.(*msg.IceRoleAttr).TieBreaker()
+	if this.controlling == (this.tieBreaker >= theirs) {
+		return false
+	}
+
+	this.controlling = !this.controlling
+	log.Println("ICE role conflict, now controlling:", this.controlling)
+	return true
+}
+
+// Answers connectivity checks with this agent's credentials.  Binding requests
+// that carry ICE attributes are authenticated with the short term credential
+// mechanism instead of the server's Authenticator.
+func (this *Server) SetICEAgent(agent *ICEAgent) {
+	this.ice = agent
+}
+
+func connectivityCheck(req *msg.Message) bool {
+	for _, t := range []msg.TLVType{msg.Priority, msg.IceControlled, msg.IceControlling} {
+		if _, err := req.Attribute(t); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Server) handleConnectivityCheck(conn *Connection) {
+
+	req := conn.Req
+	integrity, iErr := req.Attribute(msg.MessageIntegrity)
+	user, ok := req.Username()
+	if iErr != nil || !ok {
+		this.reject(conn, msg.BadRequest, "Missing Username or Integrity")
+		return
+	}
+
+	// USERNAME is the local fragment then the remote one
+	key := msg.ShortTermKey(this.ice.Password)
+	if !strings.HasPrefix(user, this.ice.Ufrag+":") ||
+		!msg.ToIntegrity(integrity).ValidKey(key, req) {
+		this.reject(conn, msg.Unauthorized, "Unauthorized")
+		return
+	}
+
+	conn.User = user
+	conn.key = key
+
+	if !this.ice.resolveRole(req) {
+		this.reject(conn, msg.RoleConflict, "Role Conflict")
+		return
+	}
+
+	conn.Write(msg.NewResponse(msg.Success, req))
+	this.deliver(conn)
+}
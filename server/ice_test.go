@@ -0,0 +1,79 @@
+package server
+
+import (
+	"github.com/ricochet2200/gun/msg"
+	"testing"
+)
+
+// A connectivity check from the remote agent "them" to ufrag "us"
+func connectivityCheckRequest(role *msg.IceRoleAttr) *msg.Message {
+	req := msg.NewRequest(msg.Binding | msg.Request)
+	u, _ := msg.NewUser("us:them")
+	req.AddAttribute(u)
+	req.AddAttribute(msg.NewPriority(1))
+	req.AddAttribute(role)
+	req.AddAttribute(msg.NewIntegrityAttrKey(msg.ShortTermKey("secret"), req))
+	return req
+}
+
+func newICEServer(controlling bool, tieBreaker uint64) *Server {
+	s := newTestServer()
+	agent := NewICEAgent("us", "secret", controlling)
+	agent.tieBreaker = tieBreaker
+	s.SetICEAgent(agent)
+	return s
+}
+
+// RFC 8445 section 7.3.1.1, the agent with the larger tie-breaker keeps the
+// role and the other is sent 487
+func TestICERoleConflict(t *testing.T) {
+
+	s := newICEServer(true, 100)
+	res := exchange(t, s, connectivityCheckRequest(msg.NewIceControlling(50)))
+	if code := errorCode(t, res); code != msg.RoleConflict {
+		t.Fatalf("smaller tie-breaker answered with %d, want 487", code)
+	}
+	if !s.ice.Controlling() {
+		t.Error("agent with the larger tie-breaker gave up controlling")
+	}
+	if _, err := res.Attribute(msg.MessageIntegrity); err != nil {
+		t.Error("487 not signed with the short term key")
+	}
+
+	s = newICEServer(false, 100)
+	res = exchange(t, s, connectivityCheckRequest(msg.NewIceControlled(200)))
+	if code := errorCode(t, res); code != msg.RoleConflict {
+		t.Fatalf("controlled conflict answered with %d, want 487", code)
+	}
+	if s.ice.Controlling() {
+		t.Error("agent with the smaller tie-breaker took control")
+	}
+}
+
+func TestICERoleSwitch(t *testing.T) {
+
+	s := newICEServer(true, 100)
+	res := exchange(t, s, connectivityCheckRequest(msg.NewIceControlling(200)))
+	if res.Type() != msg.Binding|msg.Success {
+		t.Fatalf("got type 0x%04X", uint16(res.Type()))
+	}
+	if s.ice.Controlling() {
+		t.Error("agent with the smaller tie-breaker kept controlling")
+	}
+
+	// No conflict once the roles differ
+	res = exchange(t, s, connectivityCheckRequest(msg.NewIceControlling(50)))
+	if res.Type() != msg.Binding|msg.Success {
+		t.Errorf("got type 0x%04X", uint16(res.Type()))
+	}
+}
+
+func TestICEWrongPassword(t *testing.T) {
+
+	s := newICEServer(true, 100)
+	s.ice.Password = "other"
+	res := exchange(t, s, connectivityCheckRequest(msg.NewIceControlled(50)))
+	if code := errorCode(t, res); code != msg.Unauthorized {
+		t.Errorf("wrong key answered with %d, want 401", code)
+	}
+}
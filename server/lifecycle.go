@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Returned by Serve and the Start functions once Shutdown or Close is called
+var ErrServerClosed = errors.New("Server closed")
+
+// What the server needs to stop, see Shutdown
+type lifecycle struct {
+	lock     sync.Mutex
+	stopping bool
+	open     map[io.Closer]bool // listeners, sockets and TCP connections
+	active   sync.WaitGroup     // transactions being handled
+
+	killed   chan struct{} // closed by Close
+	finished chan struct{} // closed once everything has stopped
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		open:     map[io.Closer]bool{},
+		killed:   make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+// A TCP or TLS connection being served.  idle is guarded by the lifecycle's
+// lock and true while waiting for the next request.
+type stream struct {
+	net.Conn
+	idle bool
+}
+
+// Serves STUN over both UDP and TCP on the server's port until ctx is done,
+// then shuts down gracefully.  TLS and NAT behavior discovery are served too
+// when set with SetTLS and SetDiscovery.  Also returns when Shutdown or Close
+// is called, or when any listener fails, in which case the others are closed
+// too.
+func (this *Server) Serve(ctx context.Context) error {
+
+	starts := []func() error{this.StartUDP, this.Start}
+	if this.tlsConfig != nil {
+		starts = append(starts, func() error {
+			return this.startTLS(this.tlsPort, this.tlsConfig)
+		})
+	}
+	if this.discoveryAddrs != nil {
+		starts = append(starts, func() error {
+			return this.StartDiscovery(this.discoveryAddrs[0], this.discoveryAddrs[1])
+		})
+	}
+
+	errc := make(chan error, len(starts))
+	for _, start := range starts {
+		start := start
+		go func() { errc <- start() }()
+	}
+
+	err := ErrServerClosed
+	select {
+	case <-ctx.Done():
+	case err = <-errc:
+	}
+
+	this.Shutdown(context.Background())
+	return err
+}
+
+// Stops the server without interrupting transactions being handled, like
+// net/http.Server.Shutdown.  Listeners stop accepting, sockets stop reading
+// and TCP connections waiting for a request are closed at once.  Those
+// answering one are closed once it is answered.  Once every transaction has
+// finished the sockets are closed, TURN allocations are removed, and the
+// channel given to NewServer is closed.  If ctx is done first, the server is
+// closed as by Close and ctx's error is returned.
+func (this *Server) Shutdown(ctx context.Context) error {
+
+	this.stop(false)
+
+	select {
+	case <-this.life.finished:
+		return nil
+	case <-ctx.Done():
+		this.Close()
+		return ctx.Err()
+	}
+}
+
+// Stops the server at once, closing every listener, socket and connection.
+// Transactions being handled fail to send their responses and the channel
+// given to NewServer is closed once they have returned.
+func (this *Server) Close() error {
+	this.stop(true)
+	return nil
+}
+
+func (this *Server) stop(force bool) {
+
+	life := this.life
+	life.lock.Lock()
+	defer life.lock.Unlock()
+
+	if !life.stopping {
+		life.stopping = true
+		go this.finish()
+	}
+
+	if force {
+		select {
+		case <-life.killed:
+		default:
+			close(life.killed)
+		}
+	}
+
+	for c := range life.open {
+		if force {
+			c.Close()
+			continue
+		}
+
+		// Sockets stay open so transactions can still answer
+		switch c := c.(type) {
+		case net.Listener:
+			c.Close()
+		case *stream:
+			if c.idle {
+				c.Close()
+			}
+		case interface{ SetReadDeadline(time.Time) error }:
+			c.SetReadDeadline(time.Now())
+		}
+	}
+}
+
+// Waits for the transactions being handled, then releases everything
+func (this *Server) finish() {
+
+	life := this.life
+	life.active.Wait()
+
+	life.lock.Lock()
+	for c := range life.open {
+		c.Close()
+	}
+	life.open = map[io.Closer]bool{}
+	life.lock.Unlock()
+
+	if this.relay != nil {
+		this.relay.removeAll()
+	}
+
+	if this.conns != nil {
+		close(this.conns)
+	}
+	close(life.finished)
+}
+
+// Registers c to be closed when the server stops, false if it already has
+func (this *Server) track(c io.Closer) bool {
+
+	life := this.life
+	life.lock.Lock()
+	defer life.lock.Unlock()
+
+	if life.stopping {
+		return false
+	}
+	life.open[c] = true
+	return true
+}
+
+func (this *Server) untrack(c io.Closer) {
+	life := this.life
+	life.lock.Lock()
+	delete(life.open, c)
+	life.lock.Unlock()
+}
+
+// Counts a transaction as being handled, false if the server is stopping.
+// Every true must be followed by a call to end.
+func (this *Server) begin() bool {
+
+	life := this.life
+	life.lock.Lock()
+	defer life.lock.Unlock()
+
+	if life.stopping {
+		return false
+	}
+	life.active.Add(1)
+	return true
+}
+
+func (this *Server) end() {
+	this.life.active.Done()
+}
+
+// Begins a transaction for the request arriving on s, false if the server is
+// stopping
+func (this *Server) activate(s *stream) bool {
+
+	life := this.life
+	life.lock.Lock()
+	defer life.lock.Unlock()
+
+	if life.stopping {
+		return false
+	}
+	s.idle = false
+	life.active.Add(1)
+	return true
+}
+
+// Marks s as waiting for its next request, false if the server is stopping
+// and s should be closed instead
+func (this *Server) deactivate(s *stream) bool {
+
+	life := this.life
+	life.lock.Lock()
+	defer life.lock.Unlock()
+
+	s.idle = true
+	return !life.stopping
+}
+
+func (this *Server) stopping() bool {
+	life := this.life
+	life.lock.Lock()
+	defer life.lock.Unlock()
+	return life.stopping
+}
+
+// Passes conn on to the channel given to NewServer, unless the server is
+// closed while waiting for it to be read.  What is passed on is a copy, so
+// the packet conn came in is reused as usual.
+func (this *Server) deliver(conn *Connection) {
+
+	if this.conns == nil {
+		return
+	}
+
+	select {
+	case this.conns <- conn.detach():
+		conn.delivered = true
+	case <-this.life.killed:
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/ricochet2200/gun/msg"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Serves TCP on a fresh port, returning its address and the error serve
+// returns
+func serveTCP(t *testing.T, s *Server) (string, chan error) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.serve(ln) }()
+	return ln.Addr().String(), errc
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// Waits until the server has n streams, counting the idle ones if idle
+func waitStreams(t *testing.T, s *Server, n int, idle bool) {
+
+	for i := 0; i < 500; i++ {
+		count := 0
+		s.life.lock.Lock()
+		for c := range s.life.open {
+			if st, ok := c.(*stream); ok && st.idle == idle {
+				count++
+			}
+		}
+		s.life.lock.Unlock()
+
+		if count == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("never had %d streams with idle %v", n, idle)
+}
+
+func readResponse(t *testing.T, conn net.Conn) {
+	res, err := msg.DecodeMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Type() != msg.Binding|msg.Success {
+		t.Fatalf("got type 0x%04X", uint16(res.Type()))
+	}
+}
+
+// Connections answer any number of requests, not just the first
+func TestStreamRequests(t *testing.T) {
+
+	s := NewServer(0, nil, nil)
+	addr, _ := serveTCP(t, s)
+	conn := dial(t, addr)
+
+	for i := 0; i < 3; i++ {
+		conn.Write(bindingRequest())
+		readResponse(t, conn)
+	}
+	s.Close()
+}
+
+// A stream whose Connection is passed on belongs to whoever reads it, with
+// everything the client sent after the request, and stays open after the
+// server lets go of it
+func TestDeliveredStream(t *testing.T) {
+
+	conns := make(chan *Connection, 1)
+	s := NewServer(0, conns, nil)
+	addr, _ := serveTCP(t, s)
+	defer s.Close()
+	cli := dial(t, addr)
+
+	cli.Write(append(bindingRequest(), "after"...))
+	readResponse(t, cli)
+
+	conn := <-conns
+	defer conn.Out.Close()
+	conn.Out.SetDeadline(time.Now().Add(5 * time.Second))
+	waitStreams(t, s, 0, true)
+	waitStreams(t, s, 0, false)
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn.Out, buf); err != nil || string(buf) != "after" {
+		t.Fatalf("delivered stream read %+q, %v", buf, err)
+	}
+
+	if _, err := conn.Out.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != "reply" {
+		t.Errorf("client read %+q, %v", buf, err)
+	}
+}
+
+func TestShutdownClosesIdleStreams(t *testing.T) {
+
+	s := NewServer(0, nil, nil)
+	addr, errc := serveTCP(t, s)
+	conn := dial(t, addr)
+
+	conn.Write(bindingRequest())
+	readResponse(t, conn)
+	waitStreams(t, s, 1, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle connection read %v, want EOF", err)
+	}
+	if err := <-errc; err != ErrServerClosed {
+		t.Errorf("serve returned %v", err)
+	}
+}
+
+// A request arriving before Shutdown is answered before the connection closes
+func TestShutdownDrainsStreams(t *testing.T) {
+
+	s := NewServer(0, nil, nil)
+	addr, _ := serveTCP(t, s)
+	conn := dial(t, addr)
+
+	req := bindingRequest()
+	conn.Write(req[:4])
+	waitStreams(t, s, 1, false)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v with a request being read", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	conn.Write(req[4:])
+	readResponse(t, conn)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("drained connection read %v, want EOF", err)
+	}
+}
+
+func TestCloseClosesStreams(t *testing.T) {
+
+	s := NewServer(0, nil, nil)
+	addr, _ := serveTCP(t, s)
+	conn := dial(t, addr)
+
+	conn.Write(bindingRequest()[:4])
+	waitStreams(t, s, 1, false)
+
+	s.Close()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection still open after Close")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Serve starts and stops TLS and discovery along with UDP and TCP
+func TestServeAll(t *testing.T) {
+
+	s := NewServer(0, nil, nil)
+	s.SetHost("127.0.0.1")
+	s.SetTLS(&tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return nil, errors.New("No certificate")
+	}}, 0)
+	s.SetDiscovery(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(ctx) }()
+
+	// UDP, TCP, TLS and the four discovery sockets
+	for i := 0; ; i++ {
+		s.life.lock.Lock()
+		n := len(s.life.open)
+		s.life.lock.Unlock()
+
+		if n == 7 {
+			break
+		} else if i == 500 {
+			t.Fatalf("%d listeners and sockets, want 7", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-errc; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v", err)
+	}
+	<-s.life.finished
+
+	s.life.lock.Lock()
+	defer s.life.lock.Unlock()
+	if len(s.life.open) != 0 {
+		t.Errorf("%d left open", len(s.life.open))
+	}
+}
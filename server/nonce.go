@@ -0,0 +1,183 @@
+package server
+
+import (
+	"container/list"
+	"errors"
+	"github.com/ricochet2200/gun/msg"
+	"net"
+	"sync"
+	"time"
+)
+
+// Number of used nonces remembered by NewReplayNonceManager when asked for 0
+const ReplayCacheSize = 10000
+
+// How long NewReplayNonceManager treats a repeated request as a
+// retransmission, a little over the 39.5 seconds RFC 5389 clients keep trying
+const RetransmitWindow = 40 * time.Second
+
+// Issues and checks the nonces of the long term credential mechanism
+type NonceManager interface {
+	// A new nonce for a client at ip, advertising features
+	Nonce(ip net.IP, features msg.SecurityFeatures) *msg.NonceAttr
+	// False if nonce is stale or may not be used for req from ip
+	Valid(nonce msg.TLV, ip net.IP, req *msg.Message) bool
+	// Called once req has been authenticated with nonce.  False if nonce may
+	// not be used for req after all, as when req is a replay, which is then
+	// answered with 438.  Checking and recording the use must be one step, so
+	// concurrent copies of a request cannot all pass.
+	Use(nonce msg.TLV, req *msg.Message) bool
+}
+
+// Returned by SetNonceSecret when the NonceManager was not made by this
+// package, so it has no secret the server can change
+var ErrCustomNonceManager = errors.New("Nonce manager has no secret to set")
+
+// Managers whose secret can be changed keeping everything else about them
+type secretNonces interface {
+	setSecret(secret []byte)
+}
+
+// Managers that remember the response to each use of a nonce, so a
+// retransmission is answered again rather than rejected as a replay.  Uses
+// are identified by replayKey.
+type responseCache interface {
+	// The response to the use, and true if a request repeating it from from
+	// is a retransmission.  The response is nil while the first copy is
+	// still being answered.
+	cached(key string, from net.Addr) ([]byte, bool)
+	// Remembers res as the response to the use, by a request from from
+	cache(key string, from net.Addr, res []byte)
+}
+
+// Nonces that are valid for lifetime after being issued, checked without any
+// server state.  Servers created with the same secret accept each other's.
+func NewNonceManager(secret []byte, lifetime time.Duration) NonceManager {
+	nonces := &signedNonces{lifetime: lifetime}
+	nonces.setSecret(secret)
+	return nonces
+}
+
+type signedNonces struct {
+	signer     *msg.NonceSigner
+	signerLock sync.RWMutex
+	lifetime   time.Duration
+}
+
+// Replaced while requests are being checked, see SetNonceSecret
+func (this *signedNonces) setSecret(secret []byte) {
+	signer := msg.NewNonceSigner(secret)
+	signer.SetLifetime(this.lifetime)
+
+	this.signerLock.Lock()
+	this.signer = signer
+	this.signerLock.Unlock()
+}
+
+func (this *signedNonces) current() *msg.NonceSigner {
+	this.signerLock.RLock()
+	defer this.signerLock.RUnlock()
+	return this.signer
+}
+
+func (this *signedNonces) Nonce(ip net.IP, features msg.SecurityFeatures) *msg.NonceAttr {
+	return this.current().Nonce(ip, features)
+}
+
+func (this *signedNonces) Valid(nonce msg.TLV, ip net.IP, req *msg.Message) bool {
+	return this.current().Valid(nonce, ip)
+}
+
+func (this *signedNonces) Use(nonce msg.TLV, req *msg.Message) bool {
+	return true
+}
+
+// Like NewNonceManager, but also rejects a request reusing a nonce with a
+// transaction id already authenticated, so captured requests cannot be
+// replayed.  The last size uses are remembered, with their responses.  A
+// repeat from the same address within RetransmitWindow is a retransmission,
+// and is sent the original response without being handled again.
+func NewReplayNonceManager(secret []byte, lifetime time.Duration, size int) NonceManager {
+	if size <= 0 {
+		size = ReplayCacheSize
+	}
+	nonces := &replayNonces{
+		signedNonces: signedNonces{lifetime: lifetime},
+		size:         size,
+		order:        list.New(),
+		used:         map[string]*list.Element{},
+	}
+	nonces.setSecret(secret)
+	return nonces
+}
+
+type replayNonces struct {
+	signedNonces
+	size  int
+	lock  sync.Mutex
+	order *list.List // of *nonceUse, most recently used first
+	used  map[string]*list.Element
+}
+
+type nonceUse struct {
+	key  string
+	from string
+	at   time.Time
+	res  []byte // nil until answered
+}
+
+func replayKey(nonce msg.TLV, req *msg.Message) string {
+	return string(nonce.Value()) + "|" + string(req.Header().TransactionId())
+}
+
+// Remembers the use, false if it already was
+func (this *replayNonces) Use(nonce msg.TLV, req *msg.Message) bool {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	key := replayKey(nonce, req)
+	if e, ok := this.used[key]; ok {
+		this.order.MoveToFront(e)
+		return false
+	}
+
+	this.used[key] = this.order.PushFront(&nonceUse{key: key, at: time.Now()})
+	if this.order.Len() > this.size {
+		oldest := this.order.Back()
+		this.order.Remove(oldest)
+		delete(this.used, oldest.Value.(*nonceUse).key)
+	}
+	return true
+}
+
+func (this *replayNonces) cached(key string, from net.Addr) ([]byte, bool) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	e, ok := this.used[key]
+	if !ok {
+		return nil, false
+	}
+	u := e.Value.(*nonceUse)
+	if time.Since(u.at) >= RetransmitWindow {
+		return nil, false
+	}
+	if u.res == nil {
+		return nil, true
+	}
+	return u.res, u.from == from.String()
+}
+
+func (this *replayNonces) cache(key string, from net.Addr, res []byte) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if e, ok := this.used[key]; ok {
+		u := e.Value.(*nonceUse)
+		u.from = from.String()
+		u.res = append([]byte(nil), res...)
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"github.com/ricochet2200/gun/msg"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplayRejected(t *testing.T) {
+
+	s := newTestServer()
+	s.SetNonceManager(NewReplayNonceManager([]byte("secret"), time.Minute, 0))
+	replayed(t, s)
+}
+
+// Handles data from port on 127.0.0.1 and returns the response, nil if there
+// is none
+func respondFrom(t *testing.T, s *Server, port int, data []byte) *msg.Message {
+
+	pc := &fakePacketConn{}
+	handleFrom(s, pc, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, data)
+	if pc.last == nil {
+		return nil
+	}
+
+	res := &msg.Message{}
+	if err := res.UnmarshalBinary(pc.last); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// Sends a signed request from one address and then another, the copy must be
+// answered with 438
+func replayed(t *testing.T, s *Server) {
+
+	offered := msg.NewPasswordAlgorithms(PasswordAlgorithms...)
+	req := signedRequest(t, challengeFor(t, s), msg.AlgorithmSHA256, offered).EncodeMessage()
+
+	if res := respondFrom(t, s, 1000, req); res.Type() != msg.Binding|msg.Success {
+		t.Fatalf("first use answered with %d", errorCode(t, res))
+	}
+	if code := errorCode(t, respondFrom(t, s, 2000, req)); code != msg.StaleNonce {
+		t.Fatalf("replay answered with %d", code)
+	}
+}
+
+// A copy from the same address is a retransmission, and is sent the original
+// response until RetransmitWindow has passed
+func TestReplayRetransmitted(t *testing.T) {
+
+	s := newTestServer()
+	s.SetNonceManager(NewReplayNonceManager([]byte("secret"), time.Minute, 0))
+	offered := msg.NewPasswordAlgorithms(PasswordAlgorithms...)
+	req := signedRequest(t, challengeFor(t, s), msg.AlgorithmSHA256, offered).EncodeMessage()
+
+	first := respondFrom(t, s, 1000, req)
+	again := respondFrom(t, s, 1000, req)
+	if again == nil || !bytes.Equal(first.EncodeMessage(), again.EncodeMessage()) {
+		t.Fatalf("retransmission answered with\n%v\nnot\n%v", again, first)
+	}
+
+	for _, e := range s.nonces.(*replayNonces).used {
+		e.Value.(*nonceUse).at = time.Now().Add(-RetransmitWindow)
+	}
+	if code := errorCode(t, respondFrom(t, s, 1000, req)); code != msg.StaleNonce {
+		t.Errorf("late copy answered with %d, want 438", code)
+	}
+}
+
+// RFC 5766 section 6.2, a lost Allocate response must not leave the client
+// unable to allocate
+func TestReplayAllocateRetransmitted(t *testing.T) {
+
+	s := newRelayServer(t)
+	s.SetNonceManager(NewReplayNonceManager([]byte("secret"), time.Minute, 0))
+	req := allocateRequest(challengeFor(t, s), "user")
+
+	first := allocateFrom(t, s, 1000, req)
+	again := allocateFrom(t, s, 1000, req)
+	if first.Type() != msg.Allocate|msg.Success || again.Type() != msg.Allocate|msg.Success {
+		t.Fatalf("answered with %d, then %d", errorCode(t, first), errorCode(t, again))
+	}
+	if !bytes.Equal(first.EncodeMessage(), again.EncodeMessage()) {
+		t.Errorf("retransmission answered with\n%v\nnot\n%v", again, first)
+	}
+}
+
+// Copies of a request arriving together must not all pass
+func TestConcurrentReplay(t *testing.T) {
+
+	nonces := NewReplayNonceManager([]byte("secret"), time.Minute, 0)
+	ip := net.IPv4(192, 0, 2, 1)
+	nonce := nonces.Nonce(ip, 0)
+	req := msg.NewRequest(msg.Binding | msg.Request)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	passed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if nonces.Valid(nonce, ip, req) && nonces.Use(nonce, req) {
+				lock.Lock()
+				passed++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if passed != 1 {
+		t.Fatalf("%d copies passed", passed)
+	}
+}
+
+func TestSetNonceSecretKeepsReplay(t *testing.T) {
+
+	s := newTestServer()
+	s.SetNonceManager(NewReplayNonceManager([]byte("old"), time.Minute, 0))
+	if err := s.SetNonceSecret([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.nonces.(*replayNonces); !ok {
+		t.Fatal("replay protection dropped")
+	}
+
+	ip := net.IPv4(192, 0, 2, 1)
+	if !msg.NewNonceSigner([]byte("new")).Valid(s.nonces.Nonce(ip, 0), ip) {
+		t.Fatal("nonce not signed with the new secret")
+	}
+	replayed(t, s)
+}
+
+// The secret may change while requests are being checked
+func TestSetNonceSecretConcurrent(t *testing.T) {
+
+	s := newTestServer()
+	s.SetNonceManager(NewReplayNonceManager([]byte("secret"), time.Minute, 0))
+	ip := net.IPv4(192, 0, 2, 1)
+	req := msg.NewRequest(msg.Binding | msg.Request)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.SetNonceSecret([]byte("new"))
+		}()
+		go func() {
+			defer wg.Done()
+			s.nonces.Valid(s.nonces.Nonce(ip, 0), ip, req)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSetNonceSecretCustom(t *testing.T) {
+
+	s := newTestServer()
+	custom := plainNonces{NewNonceManager([]byte("secret"), time.Minute)}
+	s.SetNonceManager(custom)
+
+	if err := s.SetNonceSecret([]byte("new")); err != ErrCustomNonceManager {
+		t.Fatalf("got %v", err)
+	}
+	if s.nonces != NonceManager(custom) {
+		t.Fatal("custom manager replaced")
+	}
+}
@@ -0,0 +1,5 @@
+// +build !race
+
+package server
+
+const raceEnabled = false
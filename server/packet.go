@@ -0,0 +1,40 @@
+package server
+
+import (
+	"github.com/ricochet2200/gun/msg"
+	"net"
+	"sync"
+)
+
+// A datagram being handled, with the storage to decode and answer it.
+// Packets are reused, so answering one allocates nothing.  A Connection
+// passed on to the channel given to NewServer is a copy, see deliver.
+type packet struct {
+	buf  []byte
+	data []byte // the datagram, in buf
+	addr net.Addr
+
+	conn Connection
+	req  msg.Message
+	res  msg.Message
+	out  []byte
+}
+
+var packets = sync.Pool{New: func() interface{} {
+	return &packet{buf: make([]byte, MaxPacketSize)}
+}}
+
+// The Connection for the packet's request, which arrived on pc
+func (this *packet) connection(pc net.PacketConn, software *msg.SoftwareAttr) *Connection {
+	this.conn = Connection{Req: &this.req, Packet: pc, Addr: this.addr, Realm: Realm,
+		software: software, res: &this.res, out: this.out, data: this.data}
+	return &this.conn
+}
+
+// Returns the packet to the pool
+func (this *packet) release() {
+	this.out = this.conn.out[:0]
+	this.conn = Connection{}
+	this.data, this.addr = nil, nil
+	packets.Put(this)
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"github.com/ricochet2200/gun/msg"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// A socket that keeps the last datagram written to it
+type fakePacketConn struct {
+	last []byte
+}
+
+func (this *fakePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return 0, nil, net.ErrClosed
+}
+
+func (this *fakePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	this.last = append(this.last[:0], b...)
+	return len(b), nil
+}
+
+func (this *fakePacketConn) Close() error                       { return nil }
+func (this *fakePacketConn) LocalAddr() net.Addr                { return &net.UDPAddr{} }
+func (this *fakePacketConn) SetDeadline(t time.Time) error      { return nil }
+func (this *fakePacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (this *fakePacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var fakeClient = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+
+func bindingRequest() []byte {
+	req := msg.NewRequest(msg.Binding | msg.Request)
+	req.AddFingerprint()
+	return req.EncodeMessage()
+}
+
+// Handles data from fakeClient as servePackets does, without the goroutine
+func handleDatagram(s *Server, pc net.PacketConn, data []byte) {
+	handleFrom(s, pc, fakeClient, data)
+}
+
+func handleFrom(s *Server, pc net.PacketConn, from net.Addr, data []byte) {
+	p := packets.Get().(*packet)
+	p.data, p.addr = p.buf[:copy(p.buf, data)], from
+	s.handlePacket(pc, p)
+	p.release()
+}
+
+func TestBindingResponse(t *testing.T) {
+
+	s, pc := NewServer(0, nil, nil), &fakePacketConn{}
+	handleDatagram(s, pc, bindingRequest())
+
+	res := &msg.Message{}
+	if err := res.UnmarshalBinary(pc.last); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := res.XORMappedAddress()
+	if err != nil || !addr.IP.Equal(fakeClient.IP) || addr.Port != fakeClient.Port {
+		t.Fatalf("got %v, %v", addr, err)
+	}
+}
+
+func TestBindingAllocations(t *testing.T) {
+
+	if raceEnabled {
+		t.Skip("packets are not always reused with the race detector")
+	}
+
+	s, pc, data := NewServer(0, nil, nil), &fakePacketConn{}, bindingRequest()
+	allocs := testing.AllocsPerRun(100, func() {
+		handleDatagram(s, pc, data)
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocations per Binding request", allocs)
+	}
+}
+
+// A Connection passed on must keep its request when more packets arrive
+func TestDeliveredPacketKept(t *testing.T) {
+
+	conns := make(chan *Connection, 2)
+	s, pc := NewServer(0, conns, nil), &fakePacketConn{}
+
+	first := bindingRequest()
+	handleDatagram(s, pc, first)
+	handleDatagram(s, pc, bindingRequest())
+
+	conn := <-conns
+	if !bytes.Equal(conn.Req.Header().TransactionId(), first[8:20]) {
+		t.Fatal("delivered request was overwritten")
+	}
+
+	// And can still be answered
+	pc.last = nil
+	conn.Write(conn.response(msg.Success))
+	if !bytes.Equal(pc.last[8:20], first[8:20]) {
+		t.Error("delivered Connection wrote nothing")
+	}
+}
+
+// Delivering copies the request out, so the packet's buffer is reused
+func TestDeliveredPacketReused(t *testing.T) {
+
+	if raceEnabled {
+		t.Skip("packets are not always reused with the race detector")
+	}
+
+	conns := make(chan *Connection, 1)
+	s, pc, data := NewServer(0, conns, nil), &fakePacketConn{}, bindingRequest()
+	handleDatagram(s, pc, data)
+	<-conns
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 100; i++ {
+		handleDatagram(s, pc, data)
+		<-conns
+	}
+	runtime.ReadMemStats(&after)
+
+	if n := (after.TotalAlloc - before.TotalAlloc) / 100; n >= MaxPacketSize {
+		t.Fatalf("%d bytes allocated per delivered request", n)
+	}
+}
+
+func BenchmarkBindingRequest(b *testing.B) {
+	s, pc, data := NewServer(0, nil, nil), &fakePacketConn{}, bindingRequest()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		handleDatagram(s, pc, data)
+	}
+}
+
+func BenchmarkDeliveredBindingRequest(b *testing.B) {
+	conns := make(chan *Connection, 1)
+	s, pc, data := NewServer(0, conns, nil), &fakePacketConn{}, bindingRequest()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		handleDatagram(s, pc, data)
+		<-conns
+	}
+}
+
+// The allocation must keep its own copy of the Allocate transaction id, as
+// the packet it came in is reused
+func TestAllocationIdCopied(t *testing.T) {
+
+	s, pc := newRelayServer(t), &fakePacketConn{}
+	allocate := allocateRequest(challengeFor(t, s), "user")
+
+	handleDatagram(s, pc, allocate)
+	handleDatagram(s, pc, bindingRequest())
+
+	a := s.relay.get(pc, fakeClient)
+	if a == nil || !bytes.Equal(a.id, allocate[8:20]) {
+		t.Fatal("allocation lost the Allocate transaction id")
+	}
+}
@@ -0,0 +1,6 @@
+// +build race
+
+package server
+
+// The race detector makes sync.Pool drop items, so pooled paths allocate
+const raceEnabled = true
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"github.com/ricochet2200/gun/msg"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+)
+
+// Decides whether a request should be sent to another server.  Redirected
+// requests are answered with 300 Try Alternate and an ALTERNATE-SERVER.
+type Redirector interface {
+	Redirect(conn *Connection) (*net.UDPAddr, bool)
+}
+
+// Redirects Binding and Allocate requests with r, nil turns redirects off.
+// Requests are authenticated before being redirected when the server has an
+// Authenticator, so that the 300 is signed and clients can trust it.
+func (this *Server) SetRedirector(r Redirector) {
+	this.redirector = r
+}
+
+// Answers with 300 and returns true if the request should go elsewhere
+func (this *Server) redirect(conn *Connection) bool {
+
+	if this.redirector == nil || conn.Req.Header().Legacy() {
+		return false
+	}
+
+	alt, ok := this.redirector.Redirect(conn)
+	if !ok {
+		return false
+	}
+
+	res := msg.NewResponse(msg.Error, conn.Req)
+	e, _ := msg.NewErrorAttr(msg.TryAlternative, "")
+	res.AddAttribute(e)
+	res.AddAttribute(msg.NewAlternateServer(alt.IP, alt.Port))
+
+	conn.Write(res)
+	return true
+}
+
+type staticRedirect struct {
+	target *net.UDPAddr
+}
+
+// Sends every client to target, for example while draining a server before
+// maintenance
+func StaticRedirect(target *net.UDPAddr) Redirector {
+	return &staticRedirect{target}
+}
+
+func (this *staticRedirect) Redirect(conn *Connection) (*net.UDPAddr, bool) {
+	return this.target, true
+}
+
+type hashRedirect struct {
+	servers []*net.UDPAddr
+	self    int
+}
+
+// Spreads clients over servers by a hash of their IP, so each client always
+// lands on the same one.  self is this server's index in servers, clients
+// hashed to it are served.  Every server should be given the same list.
+func HashRedirect(servers []*net.UDPAddr, self int) Redirector {
+	return &hashRedirect{servers, self}
+}
+
+func (this *hashRedirect) Redirect(conn *Connection) (*net.UDPAddr, bool) {
+
+	if len(this.servers) == 0 {
+		return nil, false
+	}
+
+	// IPv4 addresses come as 4 or 16 bytes depending on the socket, and every
+	// server must hash a client the same
+	h := fnv.New32a()
+	h.Write(conn.IP().To16())
+	i := int(h.Sum32() % uint32(len(this.servers)))
+
+	return this.servers[i], i != this.self
+}
+
+type loadRedirect struct {
+	target *net.UDPAddr
+	max    int
+
+	lock   sync.Mutex
+	second time.Time
+	count  int
+}
+
+// Serves up to max requests a second and sends the rest to target
+func LoadRedirect(target *net.UDPAddr, max int) Redirector {
+	return &loadRedirect{target: target, max: max}
+}
+
+func (this *loadRedirect) Redirect(conn *Connection) (*net.UDPAddr, bool) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now().Truncate(time.Second)
+	if !now.Equal(this.second) {
+		this.second = now
+		this.count = 0
+	}
+
+	this.count++
+	return this.target, this.count > this.max
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+// Sockets report IPv4 clients as 4 or 16 bytes, servers must agree on both
+func TestHashRedirectIPv4Forms(t *testing.T) {
+
+	servers := []*net.UDPAddr{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 3478},
+		{IP: net.IPv4(192, 0, 2, 2), Port: 3478},
+		{IP: net.IPv4(192, 0, 2, 3), Port: 3478},
+	}
+	r := HashRedirect(servers, 0)
+
+	for i := 0; i < 256; i++ {
+		short := &Connection{Addr: &net.UDPAddr{IP: net.IP{10, 0, 0, byte(i)}, Port: 4242}}
+		long := &Connection{Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 4242}}
+
+		a, _ := r.Redirect(short)
+		b, _ := r.Redirect(long)
+		if a != b {
+			t.Fatalf("10.0.0.%d sent to %v and %v", i, a, b)
+		}
+	}
+}
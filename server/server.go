@@ -1,7 +1,13 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
 	"github.com/ricochet2200/gun/msg"
+	"io"
 	"log"
 	"net"
 	"strconv"
@@ -9,15 +15,42 @@ import (
 
 var Realm string = "STUN Server"
 
+// Ports assigned to STUN by RFC 5389
+const DefaultPort = 3478
+const DefaultTLSPort = 5349
+
+// Largest datagram read by StartUDP
+const MaxPacketSize = 65535
+
 type Authenticator interface {
 	Password(/*username*/ string) (/*password*/string, /*ok*/bool)
 }
 
+// Authenticators that can also find a user from a USERHASH, which is
+// msg.HashUser(username, realm).  Servers with one offer username anonymity
+// so clients never send their username in the clear.
+type UserHashAuthenticator interface {
+	Authenticator
+	UserByHash(/*hash*/ []byte, /*realm*/ string) (/*username*/string, /*ok*/bool)
+}
+
 type Server struct {
+	host string
 	port int
 	conns chan *Connection
 	auth Authenticator
 	realm *msg.RealmAttr
+	legacy bool
+	relay *relay
+	ice *ICEAgent
+	nonces NonceManager
+	redirector Redirector
+	software *msg.SoftwareAttr
+	life *lifecycle
+	quota allocationQuota
+	tlsConfig *tls.Config
+	tlsPort int
+	discoveryAddrs []*net.UDPAddr
 }
 
 func NewServer(port int, c chan *Connection, a Authenticator) *Server {
@@ -26,148 +59,545 @@ func NewServer(port int, c chan *Connection, a Authenticator) *Server {
 	if e != nil {
 		panic(e)
 	}
-	return &Server{port, c, a, r}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &Server{"", port, c, a, r, false, nil, nil, NewNonceManager(secret, msg.NonceLifetime), nil, nil, newLifecycle(),
+		allocationQuota{DefaultUserQuota, DefaultAllocationQuota}, nil, 0, nil}
 }
 
+// Signs nonces with secret instead of the random one each server starts with.
+// Servers sharing a secret accept each other's nonces, so clients can move
+// between them without being challenged again.  Only the secret of the
+// server's NonceManager changes, so one set from NewReplayNonceManager keeps
+// its replay protection.  NonceManagers from outside this package are left as
+// they are and ErrCustomNonceManager is returned.
+func (this *Server) SetNonceSecret(secret []byte) error {
+	s, ok := this.nonces.(secretNonces)
+	if !ok {
+		return ErrCustomNonceManager
+	}
+	s.setSecret(secret)
+	return nil
+}
+
+// Adds a SOFTWARE attribute describing the server to every response, an
+// empty description removes it
+func (this *Server) SetSoftware(description string) error {
+
+	if description == "" {
+		this.software = nil
+		return nil
+	}
+
+	s, err := msg.NewSoftware(description)
+	if err != nil {
+		return err
+	}
+	this.software = s
+	return nil
+}
+
+// Replaces how nonces are issued and checked, for example with one from
+// NewReplayNonceManager
+func (this *Server) SetNonceManager(nonces NonceManager) {
+	this.nonces = nonces
+}
+
+// In legacy mode requests without the magic cookie are treated as RFC 3489
+// Binding requests and answered with MAPPED-ADDRESS instead of being dropped.
+// Servers with an Authenticator answer them with 401 instead, as RFC 3489
+// clients cannot send long term credentials.
+func (this *Server) SetLegacy(legacy bool) {
+	this.legacy = legacy
+}
+
+func (this *Server) decode(in io.Reader) (*msg.Message, error) {
+	if this.legacy {
+		return msg.DecodeLegacyMessage(in)
+	}
+	return msg.DecodeMessage(in)
+}
+
+func (this *Server) unmarshal(req *msg.Message, data []byte) error {
+	if this.legacy {
+		return req.UnmarshalLegacy(data)
+	}
+	return req.UnmarshalBinary(data)
+}
+
+// Restricts the listeners to host, which may be an IPv4 or IPv6 address.  By
+// default the server listens on every address of both families.
+func (this *Server) SetHost(host string) {
+	this.host = host
+}
+
+func (this *Server) address() string {
+	return net.JoinHostPort(this.host, strconv.Itoa(this.port))
+}
+
+// Serves STUN over TCP on the server's port until the server is stopped, see
+// Shutdown
 func (this *Server) Start() error {
 
-	log.Println("Listening on ", ":"+strconv.Itoa(this.port) )
-	ln, err := net.Listen("tcp", ":"+strconv.Itoa(this.port))
+	log.Println("Listening on ", this.address())
+	ln, err := net.Listen("tcp", this.address())
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return this.serve(ln)
+}
+
+// Serves STUN over TLS on the server's port, normally DefaultTLSPort.  Messages
+// are framed exactly as they are over plain TCP.
+func (this *Server) StartTLS(config *tls.Config) error {
+	return this.startTLS(this.port, config)
+}
+
+// Has Serve also serve STUN over TLS on port, normally DefaultTLSPort.  A nil
+// config turns it off.
+func (this *Server) SetTLS(config *tls.Config, port int) {
+	this.tlsConfig = config
+	this.tlsPort = port
+}
+
+func (this *Server) startTLS(port int, config *tls.Config) error {
+
+	addr := net.JoinHostPort(this.host, strconv.Itoa(port))
+	log.Println("Listening on tls", addr)
+	ln, err := tls.Listen("tcp", addr, config)
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
 		return err
-		// TODO: handle error
 	}
+	return this.serve(ln)
+}
+
+func (this *Server) serve(ln net.Listener) error {
+
+	if !this.track(ln) {
+		ln.Close()
+		return ErrServerClosed
+	}
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if this.stopping() {
+				return ErrServerClosed
+			} else if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			log.Println(err)
 			continue
 		}
 
-		raddr := conn.RemoteAddr()
-		ip := raddr.(*net.TCPAddr).IP
-		port := raddr.(*net.TCPAddr).Port
-		go this.handleConnection(conn, ip, port)
+		// Tracked before anything is read, so Close always reaches it
+		s := &stream{Conn: conn, idle: true}
+		if !this.track(s) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go this.serveStream(s)
+	}
+}
+
+// Answers requests on s one after another until the client closes it or the
+// server stops.  Each request is a transaction, Shutdown closes s while it
+// waits for the next one and lets the one being answered finish first.  Once
+// a request's Connection is passed on to the channel given to NewServer, s
+// belongs to whoever reads it and is neither read nor closed here again.
+func (this *Server) serveStream(s *stream) {
+
+	handedOff := false
+	defer this.untrack(s)
+	defer func() {
+		if !handedOff {
+			s.Close()
+		}
+	}()
+
+	conn := &bufferedConn{Conn: s.Conn, in: bufio.NewReader(s)}
+	for {
+		if _, err := conn.in.Peek(1); err != nil {
+			return
+		}
+
+		if !this.activate(s) {
+			return
+		}
+		err := this.handleConnection(conn, conn.in)
+		this.end()
+
+		if err == errHandedOff {
+			handedOff = true
+			return
+		} else if err != nil || !this.deactivate(s) {
+			return
+		}
+	}
+}
+
+// A stream's connection, read through the buffer its requests are read from
+// so a Connection passed on gets whatever the client sent after its request
+type bufferedConn struct {
+	net.Conn
+	in *bufio.Reader
+}
+
+func (this *bufferedConn) Read(b []byte) (int, error) {
+	return this.in.Read(b)
+}
+
+// Serves STUN over UDP on the server's port.  Every datagram is decoded as a
+// single message and answered to the address it came from.
+func (this *Server) StartUDP() error {
+
+	log.Println("Listening on udp", this.address())
+	pc, err := net.ListenPacket("udp", this.address())
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	// Closed once the server has stopped, as transactions may still answer
+	if !this.track(pc) {
+		pc.Close()
+		return ErrServerClosed
+	}
+
+	return this.servePackets(pc, func(p *packet) {
+		this.handlePacket(pc, p)
+	})
+}
+
+// Reads datagrams from pc until it is closed or the server stops, passing each
+// to handle in its own goroutine.  Each is read into a pooled packet, which
+// goes back to the pool once handled.
+func (this *Server) servePackets(pc net.PacketConn, handle func(*packet)) error {
+
+	for {
+		p := packets.Get().(*packet)
+		n, addr, err := pc.ReadFrom(p.buf)
+		if err != nil {
+			packets.Put(p)
+			if this.stopping() {
+				return ErrServerClosed
+			} else if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Println(err)
+			continue
+		}
+
+		if !this.begin() {
+			packets.Put(p)
+			return ErrServerClosed
+		}
+
+		p.data, p.addr = p.buf[:n], addr
+		go func() {
+			defer this.end()
+			handle(p)
+			p.release()
+		}()
 	}
-	return nil
 }
 
-func (this *Server) handleConnection(out net.Conn, ip net.IP, port int) {
+// Returned by handleConnection when the request's Connection was passed on
+var errHandedOff = errors.New("Connection passed on")
 
-	req, err := msg.DecodeMessage(out)
+// Answers the next request read from in, which buffers out, an error if
+// there is none
+func (this *Server) handleConnection(out net.Conn, in io.Reader) error {
+
+	req, err := this.decode(in)
 	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	conn := &Connection{Req: req, Out: out, Realm: Realm, software: this.software}
+	this.handleRequest(conn)
+	if conn.delivered {
+		return errHandedOff
+	}
+	return nil
+}
+
+func (this *Server) handlePacket(pc net.PacketConn, p *packet) {
+
+	if this.relay != nil && msg.IsChannelData(p.data) {
+		this.relay.channelData(pc, p.addr, p.data)
+		return
+	}
+
+	// The packet's data belongs to it alone, so it is decoded in place
+	if err := this.unmarshal(&p.req, p.data); err != nil {
 		log.Println(err)
 		return
 	}
 
-	conn := &Connection{Req: req, Out: out, Realm: Realm}
+	this.handleRequest(p.connection(pc, this.software))
+}
+
+func (this *Server) handleRequest(conn *Connection) {
+
+	req := conn.Req
+
+	// RFC 5389 section 7.3.1, indications with them are dropped
+	if unknown := req.UnknownRequired(); len(unknown) > 0 {
+		if req.Type()&msg.ClassMask == msg.Request {
+			res := msg.NewResponse(msg.Error, req)
+			e, _ := msg.NewErrorAttr(msg.UnknownAttribute, "")
+			res.AddAttribute(e)
+			res.AddAttribute(msg.NewUnknownAttributes(unknown))
+			conn.Write(res)
+		}
+		log.Println("Unknown comprehension-required attributes", unknown)
+		return
+	}
 
 	switch req.Type() {
 	case msg.Binding | msg.Request:
 
-		if this.auth == nil {
-			log.Println("Binding to address:", ip, port)
- 			res := msg.NewResponse(msg.Success, req)
-			xorAddr := msg.NewXORAddress(ip, port, res.Header())
-			res.AddAttribute(xorAddr)
-			
-			out.Write(res.EncodeMessage())
+		if this.ice != nil && connectivityCheck(req) {
+			this.handleConnectivityCheck(conn)
+			return
+		}
 
-			this.conns <- conn
+		// RFC 3489 has no way to carry long term credentials, so a server
+		// that requires them cannot serve its clients
+		if this.auth != nil && req.Header().Legacy() {
+			this.reject(conn, msg.Unauthorized, "Legacy request needs credentials")
+			return
+		} else if this.auth != nil && !this.Validate(conn) {
 			return
-		} 
+		}
 
-		if this.Validate(conn) {
-			conn.Write(msg.NewResponse(msg.Success, req))
-			this.conns <- conn
+		if this.redirect(conn) {
+			return
 		}
 
+		conn.Write(conn.response(msg.Success))
+		this.deliver(conn)
+
+	case msg.Allocate | msg.Request, msg.Refresh | msg.Request,
+		msg.CreatePermission | msg.Request, msg.ChannelBind | msg.Request:
+
+		// Allocations are tied to a 5-tuple, so only datagrams are relayed
+		if this.relay == nil || conn.Packet == nil {
+			this.deliver(conn)
+			return
+		}
+
+		// Relays are never open, EnableRelay needs an Authenticator
+		if !this.Validate(conn) {
+			return
+		}
+
+		// Only new allocations move, the rest belong to one that exists here
+		if req.Type() == msg.Allocate|msg.Request &&
+			this.relay.get(conn.Packet, conn.Addr) == nil && this.redirect(conn) {
+			return
+		}
+		this.handleTURN(conn)
+
+	case msg.Send | msg.Indication:
+		if this.relay == nil || conn.Packet == nil {
+			this.deliver(conn)
+			return
+		}
+		this.relay.send(conn)
+
 	default: // Unrecognized messages
-		this.conns <- conn
+		this.deliver(conn)
 	}
 }
 
+// Password algorithms offered to clients, most preferred first
+var PasswordAlgorithms = []msg.PasswordAlgorithmID{msg.AlgorithmSHA256, msg.AlgorithmMD5}
+
 // If the request is not valid this function sends a proper message back to the
 // client.  Updates user, passwd, and realm fields in conn.  Not all fields are
 // guaranteed to be correct unless Validate() return true
 func (this *Server) Validate(conn *Connection) bool {
 
 	req := conn.Req
+	conn.Realm = this.realm.String()
 	
 	// Request attributes
 	integrity, iErr := req.Attribute(msg.MessageIntegrity)
-	user, uErr := req.Attribute(msg.Username)
+	if sha, err := req.Attribute(msg.MessageIntegritySHA256); err == nil {
+		integrity, iErr = sha, nil
+		conn.integrity = msg.MessageIntegritySHA256
+	}
+	user, uErr := this.username(req, conn.Realm)
 	_, rErr := req.Attribute(msg.Realm)
 	nonce, nErr := req.Attribute(msg.Nonce)
+	alg, algOk := passwordAlgorithm(req)
 	ok := false
 
 	// Response attributes
 	res := msg.NewResponse(msg.Error, req)
-	n := msg.NewNonce()
+	challenge := func(code msg.StunErrorCode, reason string) {
+		if code != msg.StaleNonce {
+			unsigned(conn)
+		}
+		e, _ := msg.NewErrorAttr(code, reason)
+		res.AddAttribute(e)
+		res.AddAttribute(this.realm)
+		res.AddAttribute(this.nonces.Nonce(conn.IP(), this.features()))
+		res.AddAttribute(msg.NewPasswordAlgorithms(PasswordAlgorithms...))
+		conn.Write(res)
+	}
 
 	if uErr == nil {
-		conn.User = user.(*msg.UserAttr).String()
+		conn.User = user
 		conn.Passwd, ok = this.auth.Password(conn.User)
+		if ok {
+			// Prepared as clients prepare theirs, which refuse passwords
+			// that cannot be, so such a user can never authenticate
+			var err error
+			conn.Passwd, err = msg.PrepareOpaque(conn.Passwd)
+			ok = err == nil
+		}
 		if ok {
 			conn.HasAuth = true
+			conn.key = msg.PasswordKey(alg, conn.User, conn.Realm, conn.Passwd)
 		}
 	}
 	
 	if iErr != nil {
-		// Reject request
-		e, _ := msg.NewErrorAttr(msg.Unauthorized, "Unauthorized")
-		res.AddAttribute(e)
-		res.AddAttribute(this.realm)
-		res.AddAttribute(n)
-		
 		log.Println("No Integrity")
-		conn.Write(res)
+		challenge(msg.Unauthorized, "Unauthorized")
 		return false
 
-	} else if uErr != nil || rErr != nil || nErr != nil {
+	} else if (uErr != nil && uErr != errUnknownUserHash) || rErr != nil || nErr != nil || !algOk {
 		// Reject request
-		e, _ := msg.NewErrorAttr(msg.BadRequest, "Bad Request")
+		e, _ := msg.NewErrorAttr(msg.BadRequest, "")
 		res.AddAttribute(e)
 		
-		log.Println("Missing user, nonce, or realm")
+		log.Println("Missing user, nonce, or realm, or bad password algorithm")
+		unsigned(conn)
 		conn.Write(res)
 		return false
 
 	} else if !ok {
-		// Reject request
-		res := msg.NewResponse(msg.Error, req)
-		e, _ := msg.NewErrorAttr(msg.Unauthorized, "User Not Found")
-		res.AddAttribute(e)
-		res.AddAttribute(this.realm)
-		res.AddAttribute(n)
-		
 		log.Println("User Not Found")
-		conn.Write(res)	
+		challenge(msg.Unauthorized, "User Not Found")
 		return false
 
-	} else if !msg.ValidNonce(nonce) {
-		// Reject request
-		e, _ := msg.NewErrorAttr(msg.StaleNonce, "Stale Nonce")
-		res.AddAttribute(e)
-		res.AddAttribute(this.realm)
-		res.AddAttribute(n)
-		
+	} else if !this.nonces.Valid(nonce, conn.IP(), req) {
 		log.Println("Invalid Nonce")
-		conn.Write(res)
+		challenge(msg.StaleNonce, "Stale Nonce")
 		return false
 		
-	} else if !msg.ToIntegrity(integrity).Valid(conn.User, conn.Passwd, Realm, req) {
-
-		e, _ := msg.NewErrorAttr(msg.Unauthorized, "Unauthorized")
-		res.AddAttribute(e)
-		res.AddAttribute(this.realm)
-		res.AddAttribute(n)
-		
+	} else if !validIntegrity(integrity, conn.key, req) {
 		log.Println("Invalid integrity")
-		conn.Write(res)
+		challenge(msg.Unauthorized, "Unauthorized")
+		return false
+
+	} else if !this.nonces.Use(nonce, req) {
+		if cache, ok := this.nonces.(responseCache); ok {
+			// Answered as the first copy was, or not at all while it is
+			// still being answered
+			if res, ok := cache.cached(replayKey(nonce, req), conn.RemoteAddr()); ok {
+				if res != nil {
+					conn.transmit(res)
+				}
+				return false
+			}
+		}
+		log.Println("Nonce already used")
+		challenge(msg.StaleNonce, "Stale Nonce")
 		return false
 	}
 
+	if cache, ok := this.nonces.(responseCache); ok {
+		key, from := replayKey(nonce, req), conn.RemoteAddr()
+		conn.sent = func(res []byte) { cache.cache(key, from, res) }
+	}
 	return true
 }
+
+// Security features advertised in nonces
+func (this *Server) features() msg.SecurityFeatures {
+	features := msg.FeaturePasswordAlgorithms
+	if _, ok := this.auth.(UserHashAuthenticator); ok {
+		features |= msg.FeatureUsernameAnonymity
+	}
+	return features
+}
+
+var errUnknownUserHash = errors.New("Unknown USERHASH")
+
+// The user named by the request's USERNAME, or by its USERHASH when the
+// Authenticator can look one up.  An unknown hash returns errUnknownUserHash,
+// and is answered with 401 like an unknown USERNAME.
+func (this *Server) username(req *msg.Message, realm string) (string, error) {
+
+	// Prepared again in case the client did not.  Clients refuse usernames
+	// that cannot be prepared, so one is a bad request.
+	if u, ok := req.Username(); ok {
+		return msg.PrepareUsername(u)
+	}
+
+	h, err := req.Attribute(msg.UserHash)
+	if err != nil {
+		return "", err
+	}
+
+	if lookup, ok := this.auth.(UserHashAuthenticator); ok {
+		if user, ok := lookup.UserByHash(h.(*msg.UserHashAttr).Hash(), realm); ok {
+			return user, nil
+		}
+	}
+	return "", errUnknownUserHash
+}
+
+// 400 and 401 responses must not carry MESSAGE-INTEGRITY, RFC 5389 section 10.2.2
+func unsigned(conn *Connection) {
+	conn.HasAuth = false
+	conn.key = nil
+}
+
+// The password algorithm a request chose, RFC 8489 section 9.2.4.  A request
+// with neither PASSWORD-ALGORITHM nor PASSWORD-ALGORITHMS uses MD5, unless its
+// nonce advertised password algorithms.  Then the client saw the offer, so
+// their absence means an attacker stripped them to force MD5.  Otherwise the
+// request must carry both, with the list exactly as offered so that the
+// stronger algorithms cannot have been stripped from the challenge.
+func passwordAlgorithm(req *msg.Message) (msg.PasswordAlgorithmID, bool) {
+
+	advertised := false
+	if nonce, ok := req.Nonce(); ok {
+		advertised = nonce.Features()&msg.FeaturePasswordAlgorithms != 0
+	}
+
+	a, aErr := req.Attribute(msg.PasswordAlgorithm)
+	as, asErr := req.Attribute(msg.PasswordAlgorithms)
+	if aErr != nil && asErr != nil && !advertised {
+		return msg.AlgorithmMD5, true
+	} else if aErr != nil || asErr != nil {
+		return 0, false
+	}
+
+	offered := msg.NewPasswordAlgorithms(PasswordAlgorithms...)
+	if !bytes.Equal(as.Value(), offered.Value()) {
+		return 0, false
+	}
+
+	alg := a.(*msg.PasswordAlgorithmAttr).Algorithm()
+	return alg, offered.Contains(alg)
+}
+
+func validIntegrity(integrity msg.TLV, key []byte, req *msg.Message) bool {
+	if i, ok := integrity.(*msg.IntegritySHA256Attr); ok {
+		return i.ValidKey(key, req)
+	}
+	return msg.ToIntegrity(integrity).ValidKey(key, req)
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"github.com/ricochet2200/gun/msg"
+	"testing"
+)
+
+const unknownRequired msg.TLVType = 0x7F01
+const unknownOptional msg.TLVType = 0xFF01
+
+// Handles req from fakeClient and returns the response, nil if there is none
+func respond(t *testing.T, s *Server, req *msg.Message) *msg.Message {
+
+	pc := &fakePacketConn{}
+	handleDatagram(s, pc, req.EncodeMessage())
+	if pc.last == nil {
+		return nil
+	}
+
+	res := &msg.Message{}
+	if err := res.UnmarshalBinary(pc.last); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// RFC 5389 section 7.3.1, each unknown comprehension-required type is listed
+// once and unknown optional ones are ignored
+func TestUnknownRequiredAttributes(t *testing.T) {
+
+	req := msg.NewRequest(msg.Binding | msg.Request)
+	req.AddDupAttribute(msg.NewTLV(unknownRequired, []byte{1}))
+	req.AddDupAttribute(msg.NewTLV(unknownRequired, []byte{2}))
+	req.AddAttribute(msg.NewTLV(unknownOptional, []byte{3}))
+
+	res := respond(t, NewServer(0, nil, nil), req)
+	if res == nil {
+		t.Fatal("no response")
+	}
+	if code := errorCode(t, res); code != msg.UnknownAttribute {
+		t.Fatalf("answered with %d, want 420", code)
+	}
+
+	a, err := res.Attribute(msg.UnknownTLVTypes)
+	if err != nil {
+		t.Fatal("no UNKNOWN-ATTRIBUTES")
+	}
+	types := a.(*msg.UnknownAttributesAttr).Types()
+	if len(types) != 1 || types[0] != unknownRequired {
+		t.Errorf("UNKNOWN-ATTRIBUTES lists %v, want [0x7F01]", types)
+	}
+}
+
+func TestUnknownOptionalAttributes(t *testing.T) {
+
+	req := msg.NewRequest(msg.Binding | msg.Request)
+	req.AddAttribute(msg.NewTLV(unknownOptional, []byte{3}))
+
+	res := respond(t, NewServer(0, nil, nil), req)
+	if res == nil || res.Type() != msg.Binding|msg.Success {
+		t.Fatalf("unknown optional attribute not ignored: %v", res)
+	}
+}
+
+// Indications are never answered, not even with 420
+func TestUnknownRequiredIndication(t *testing.T) {
+
+	req := msg.NewRequest(msg.Binding | msg.Indication)
+	req.AddAttribute(msg.NewTLV(unknownRequired, []byte{1}))
+
+	if res := respond(t, NewServer(0, nil, nil), req); res != nil {
+		t.Errorf("indication answered with 0x%04X", uint16(res.Type()))
+	}
+}
+
+// RFC 5389 section 15.10, on every response once set, errors included
+func TestSoftware(t *testing.T) {
+
+	s := newTestServer()
+	if err := s.SetSoftware("gun test"); err != nil {
+		t.Fatal(err)
+	}
+
+	res := respond(t, s, msg.NewRequest(msg.Binding|msg.Request))
+	if code := errorCode(t, res); code != msg.Unauthorized {
+		t.Fatalf("answered with %d, want 401", code)
+	}
+	if sw, ok := res.Software(); !ok || sw != "gun test" {
+		t.Errorf("401 SOFTWARE %+q, %v", sw, ok)
+	}
+
+	s = NewServer(0, nil, nil)
+	s.SetSoftware("gun test")
+	res = respond(t, s, msg.NewRequest(msg.Binding|msg.Request))
+	if sw, ok := res.Software(); !ok || sw != "gun test" {
+		t.Errorf("success SOFTWARE %+q, %v", sw, ok)
+	}
+
+	s.SetSoftware("")
+	res = respond(t, s, msg.NewRequest(msg.Binding|msg.Request))
+	if _, ok := res.Software(); ok {
+		t.Error("SOFTWARE still sent after it was removed")
+	}
+
+	long := make([]byte, 128)
+	for i := range long {
+		long[i] = 'a'
+	}
+	if err := s.SetSoftware(string(long)); err == nil {
+		t.Error("128 character description accepted")
+	}
+}
+
+// An RFC 3489 Binding request, with no magic cookie
+func legacyRequest() []byte {
+	req := make([]byte, 20)
+	req[1] = byte(msg.Binding | msg.Request)
+	copy(req[4:], "legacy-request-1")
+	return req
+}
+
+func respondLegacy(t *testing.T, s *Server) *msg.Message {
+
+	pc := &fakePacketConn{}
+	handleDatagram(s, pc, legacyRequest())
+	if pc.last == nil {
+		t.Fatal("no response")
+	}
+
+	res := &msg.Message{}
+	if err := res.UnmarshalLegacy(pc.last); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestLegacyBinding(t *testing.T) {
+
+	s := NewServer(0, nil, nil)
+	s.SetLegacy(true)
+
+	res := respondLegacy(t, s)
+	if res.Type() != msg.Binding|msg.Success {
+		t.Fatalf("got type 0x%04X", uint16(res.Type()))
+	}
+	if string(res.Header().TransactionId()) != "legacy-request-1" {
+		t.Errorf("transaction id %+q", res.Header().TransactionId())
+	}
+
+	addr, err := res.MappedAddress()
+	if err != nil || !addr.IP.Equal(fakeClient.IP) || addr.Port != fakeClient.Port {
+		t.Errorf("MAPPED-ADDRESS %v, %v, want %v", addr, err, fakeClient)
+	}
+	if _, err := res.XORMappedAddress(); err == nil {
+		t.Error("XOR-MAPPED-ADDRESS sent to an RFC 3489 client")
+	}
+
+	// Without legacy mode they are dropped
+	s.SetLegacy(false)
+	pc := &fakePacketConn{}
+	handleDatagram(s, pc, legacyRequest())
+	if pc.last != nil {
+		t.Error("legacy request answered outside legacy mode")
+	}
+}
+
+// RFC 3489 clients cannot authenticate, so they must not get an address from
+// a server that requires credentials
+func TestLegacyBindingNeedsCredentials(t *testing.T) {
+
+	s := newTestServer()
+	s.SetLegacy(true)
+
+	res := respondLegacy(t, s)
+	if res.Type() != msg.Binding|msg.Error {
+		t.Fatalf("got type 0x%04X, want an error", uint16(res.Type()))
+	}
+	if code := errorCode(t, res); code != msg.Unauthorized {
+		t.Errorf("answered with %d, want 401", code)
+	}
+	if _, err := res.MappedAddress(); err == nil {
+		t.Error("MAPPED-ADDRESS sent without credentials")
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/ricochet2200/gun/msg"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// A self-signed certificate for localhost and 127.0.0.1, and a pool trusting
+// it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// Binding requests over TLS are framed and answered as over TCP
+func TestTLSBinding(t *testing.T) {
+
+	cert, pool := testCertificate(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(0, nil, nil)
+	go s.serve(tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}}))
+	defer s.Close()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write(bindingRequest())
+	res, err := msg.DecodeMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Type() != msg.Binding|msg.Success {
+		t.Fatalf("got type 0x%04X", uint16(res.Type()))
+	}
+
+	addr, err := res.XORMappedAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if !addr.IP.Equal(local.IP) || addr.Port != local.Port {
+		t.Errorf("mapped %v, want %v", addr, local)
+	}
+}
@@ -0,0 +1,438 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ricochet2200/gun/msg"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Allocation lifetimes, RFC 5766 section 2.2
+const DefaultLifetime = 10 * time.Minute
+const MaxLifetime = time.Hour
+
+const PermissionLifetime = 5 * time.Minute
+const ChannelLifetime = 10 * time.Minute
+
+// Allocations one user and the whole server may have at once unless changed
+// with SetAllocationQuota, RFC 5766 section 6.2
+const DefaultUserQuota = 10
+const DefaultAllocationQuota = 1000
+
+// Returned by EnableRelay for servers without an Authenticator, as RFC 5766
+// section 6.2 requires Allocate requests to be authenticated
+var ErrNoAuthenticator = errors.New("Relaying needs an Authenticator")
+
+// TURN allocations for every client of one server.  Allocations are keyed by
+// the client's 5-tuple, the server socket plus the client address.
+type relay struct {
+	ip          net.IP
+	lock        sync.Mutex
+	allocations map[string]*allocation
+	users       map[string]int // allocations each user has
+}
+
+// Most allocations a user and the server may have, 0 for no limit
+type allocationQuota struct {
+	user  int
+	total int
+}
+
+type allocation struct {
+	key     string
+	user    string
+	id      []byte        // transaction id of the Allocate request
+	granted time.Duration // lifetime the Allocate request was given
+
+	conn    net.PacketConn // server socket the client talks to
+	client  net.Addr
+	relayed net.PacketConn
+
+	lock        sync.Mutex
+	timer       *time.Timer
+	permissions map[string]time.Time // peer IP to expiry
+	channels    map[uint16]*channel
+}
+
+type channel struct {
+	peer    *net.UDPAddr
+	expires time.Time
+}
+
+// Turns on TURN relaying over UDP.  Relayed addresses are bound on ip with a
+// port chosen by the system.  Every TURN request is authenticated with
+// Validate, so the server must have an Authenticator or ErrNoAuthenticator is
+// returned.
+func (this *Server) EnableRelay(ip net.IP) error {
+	if this.auth == nil {
+		return ErrNoAuthenticator
+	}
+	this.relay = &relay{ip: ip, allocations: map[string]*allocation{}, users: map[string]int{}}
+	return nil
+}
+
+// Limits the allocations each user and the whole server may have at once.
+// Allocate requests beyond either are answered with 486 Allocation Quota
+// Reached.  0 means no limit.
+func (this *Server) SetAllocationQuota(perUser, total int) {
+	this.quota = allocationQuota{perUser, total}
+}
+
+func allocationKey(conn net.PacketConn, client net.Addr) string {
+	return conn.LocalAddr().String() + "|" + client.String()
+}
+
+func (this *relay) get(conn net.PacketConn, client net.Addr) *allocation {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.allocations[allocationKey(conn, client)]
+}
+
+// Adds a, false if its user or the server already has all quota allows
+func (this *relay) add(a *allocation, quota allocationQuota) bool {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if quota.user > 0 && this.users[a.user] >= quota.user {
+		return false
+	} else if quota.total > 0 && len(this.allocations) >= quota.total {
+		return false
+	}
+
+	this.allocations[a.key] = a
+	this.users[a.user]++
+	return true
+}
+
+func (this *relay) remove(a *allocation) {
+	this.lock.Lock()
+	if this.allocations[a.key] == a {
+		delete(this.allocations, a.key)
+		if this.users[a.user]--; this.users[a.user] <= 0 {
+			delete(this.users, a.user)
+		}
+	}
+	this.lock.Unlock()
+
+	a.timer.Stop()
+	a.relayed.Close()
+}
+
+func (this *relay) removeAll() {
+
+	this.lock.Lock()
+	all := make([]*allocation, 0, len(this.allocations))
+	for _, a := range this.allocations {
+		all = append(all, a)
+	}
+	this.lock.Unlock()
+
+	for _, a := range all {
+		this.remove(a)
+	}
+}
+
+// Clamps a requested lifetime, zero means the client asked for none
+func lifetime(req *msg.Message) time.Duration {
+
+	l, err := req.Attribute(msg.Lifetime)
+	if err != nil {
+		return DefaultLifetime
+	}
+
+	d := l.(*msg.LifetimeAttr).Lifetime()
+	if d == 0 {
+		return 0
+	} else if d < DefaultLifetime {
+		return DefaultLifetime
+	} else if d > MaxLifetime {
+		return MaxLifetime
+	}
+	return d
+}
+
+func (this *Server) reject(conn *Connection, code msg.StunErrorCode, reason string) {
+
+	res := msg.NewResponse(msg.Error, conn.Req)
+	e, _ := msg.NewErrorAttr(code, reason)
+	res.AddAttribute(e)
+
+	log.Println(reason)
+	conn.Write(res)
+}
+
+// Handles authenticated TURN requests
+func (this *Server) handleTURN(conn *Connection) {
+
+	req := conn.Req
+	if req.Type()&msg.MethodMask == msg.Allocate {
+		this.allocate(conn)
+		return
+	}
+
+	a := this.relay.get(conn.Packet, conn.Addr)
+	if a == nil {
+		this.reject(conn, msg.AllocationMismatch, "Allocation Mismatch")
+		return
+	} else if a.user != conn.User {
+		this.reject(conn, msg.WrongCredentials, "Wrong Credentials")
+		return
+	}
+
+	switch req.Type() & msg.MethodMask {
+	case msg.Refresh:
+		d := lifetime(req)
+		if d == 0 {
+			this.relay.remove(a)
+		} else {
+			a.timer.Reset(d)
+		}
+
+		res := msg.NewResponse(msg.Success, req)
+		res.AddAttribute(msg.NewLifetime(d))
+		conn.Write(res)
+
+	case msg.CreatePermission:
+		peers := req.Attributes(msg.XORPeerAddress)
+		if len(peers) == 0 {
+			this.reject(conn, msg.BadRequest, "Missing Peer Address")
+			return
+		}
+
+		ips := []net.IP{}
+		for _, p := range peers {
+			ip, err := p.(*msg.XORAddress).IP(req.Header())
+			if err != nil {
+				this.reject(conn, msg.BadRequest, "Bad Peer Address")
+				return
+			}
+			ips = append(ips, ip)
+		}
+
+		a.lock.Lock()
+		for _, ip := range ips {
+			a.permissions[ip.String()] = time.Now().Add(PermissionLifetime)
+		}
+		a.lock.Unlock()
+
+		conn.Write(msg.NewResponse(msg.Success, req))
+
+	case msg.ChannelBind:
+		n, nErr := req.Attribute(msg.ChannelNumber)
+		if nErr != nil {
+			this.reject(conn, msg.BadRequest, "Missing Channel Number or Peer Address")
+			return
+		}
+
+		number := n.(*msg.ChannelNumberAttr).Channel()
+		peer, err := req.XORPeerAddress()
+		if err != nil || number < msg.MinChannel || number > msg.MaxChannel {
+			this.reject(conn, msg.BadRequest, "Bad Channel Number or Peer Address")
+			return
+		}
+
+		if !a.bind(number, &peer) {
+			this.reject(conn, msg.BadRequest, "Channel Already Bound")
+			return
+		}
+		conn.Write(msg.NewResponse(msg.Success, req))
+	}
+}
+
+func (this *Server) allocate(conn *Connection) {
+
+	req := conn.Req
+	if a := this.relay.get(conn.Packet, conn.Addr); a != nil {
+		if !bytes.Equal(a.id, req.Header().TransactionId()) {
+			this.reject(conn, msg.AllocationMismatch, "Allocation Mismatch")
+			return
+		}
+
+		// Retransmitted Allocate, answer it again
+		conn.Write(a.response(req))
+		return
+	}
+
+	t, err := req.Attribute(msg.RequestedTransport)
+	if err != nil {
+		this.reject(conn, msg.BadRequest, "Missing Requested Transport")
+		return
+	} else if t.(*msg.RequestedTransportAttr).Protocol() != msg.TransportUDP {
+		this.reject(conn, msg.UnsupportedTransport, "Unsupported Transport Protocol")
+		return
+	}
+
+	d := lifetime(req)
+	if d == 0 {
+		d = DefaultLifetime
+	}
+
+	relayed, err := net.ListenPacket("udp", net.JoinHostPort(this.relay.ip.String(), "0"))
+	if err != nil {
+		log.Println(err)
+		this.reject(conn, msg.InsufficientCapacity, "Insufficient Capacity")
+		return
+	}
+
+	a := &allocation{
+		key:         allocationKey(conn.Packet, conn.Addr),
+		user:        conn.User,
+		id:          append([]byte{}, req.Header().TransactionId()...),
+		granted:     d,
+		conn:        conn.Packet,
+		client:      conn.Addr,
+		relayed:     relayed,
+		permissions: map[string]time.Time{},
+		channels:    map[uint16]*channel{},
+	}
+	a.timer = time.AfterFunc(d, func() { this.relay.remove(a) })
+
+	if !this.relay.add(a, this.quota) {
+		a.timer.Stop()
+		relayed.Close()
+		this.reject(conn, msg.AllocationQuota, "Allocation Quota Reached")
+		return
+	}
+
+	log.Println("Relaying for", conn.Addr, "on", relayed.LocalAddr())
+	go a.serve()
+
+	conn.Write(a.response(req))
+}
+
+// The success response to the Allocate request.  Retransmissions of it are
+// answered with the same, RFC 5766 section 6.2.
+func (this *allocation) response(req *msg.Message) *msg.Message {
+	res := msg.NewResponse(msg.Success, req)
+	ip, port := addrIPPort(this.relayed.LocalAddr())
+	res.AddAttribute(msg.NewXORRelayedAddress(ip, port, res.Header()))
+	res.AddAttribute(msg.NewLifetime(this.granted))
+	return res
+}
+
+// Binds number to peer, refreshing the binding and the peer's permission.
+// Fails if either is already bound to something else.
+func (this *allocation) bind(number uint16, peer *net.UDPAddr) bool {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	for n, c := range this.channels {
+		if now.After(c.expires) {
+			continue
+		}
+		samePeer := c.peer.IP.Equal(peer.IP) && c.peer.Port == peer.Port
+		if (n == number) != samePeer {
+			return false
+		}
+	}
+
+	this.channels[number] = &channel{peer, now.Add(ChannelLifetime)}
+	this.permissions[peer.IP.String()] = now.Add(PermissionLifetime)
+	return true
+}
+
+func (this *allocation) permitted(ip net.IP) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	expires, ok := this.permissions[ip.String()]
+	return ok && time.Now().Before(expires)
+}
+
+func (this *allocation) channelPeer(number uint16) *net.UDPAddr {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	c, ok := this.channels[number]
+	if !ok || time.Now().After(c.expires) {
+		return nil
+	}
+	return c.peer
+}
+
+func (this *allocation) peerChannel(peer *net.UDPAddr) (uint16, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	for n, c := range this.channels {
+		if now.Before(c.expires) && c.peer.IP.Equal(peer.IP) && c.peer.Port == peer.Port {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// Forwards traffic from peers to the client until the allocation is removed
+func (this *allocation) serve() {
+
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, addr, err := this.relayed.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		peer, ok := addr.(*net.UDPAddr)
+		if !ok || !this.permitted(peer.IP) {
+			continue
+		}
+
+		if number, ok := this.peerChannel(peer); ok {
+			cd := &msg.ChannelData{Channel: number, Data: buf[:n]}
+			this.conn.WriteTo(cd.Encode(), this.client)
+			continue
+		}
+
+		ind := msg.NewRequest(msg.Data | msg.Indication)
+		ind.AddAttribute(msg.NewXORPeerAddress(peer.IP, peer.Port, ind.Header()))
+		ind.AddAttribute(msg.NewDataAttr(buf[:n]))
+		this.conn.WriteTo(ind.EncodeMessage(), this.client)
+	}
+}
+
+// Relays a Send indication to its peer.  Indications get no answer, so
+// anything wrong with it is silently dropped.
+func (this *relay) send(conn *Connection) {
+
+	a := this.get(conn.Packet, conn.Addr)
+	if a == nil {
+		return
+	}
+
+	req := conn.Req
+	peer, pErr := req.XORPeerAddress()
+	d, dErr := req.Attribute(msg.DataAttribute)
+	if pErr != nil || dErr != nil || !a.permitted(peer.IP) {
+		return
+	}
+
+	a.relayed.WriteTo(d.Value(), &peer)
+}
+
+// Relays a ChannelData message from a client to the peer bound to its channel
+func (this *relay) channelData(conn net.PacketConn, client net.Addr, data []byte) {
+
+	a := this.get(conn, client)
+	if a == nil {
+		return
+	}
+
+	cd, err := msg.DecodeChannelData(data)
+	if err != nil {
+		return
+	}
+
+	peer := a.channelPeer(cd.Channel)
+	if peer == nil {
+		return
+	}
+
+	a.relayed.WriteTo(cd.Data, peer)
+}
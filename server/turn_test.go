@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"github.com/ricochet2200/gun/msg"
+	"net"
+	"testing"
+)
+
+func newRelayServer(t *testing.T) *Server {
+	s := NewServer(0, nil, testAuth{"user": "pass", "other": "pass"})
+	if err := s.EnableRelay(net.IPv4(127, 0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.relay.removeAll)
+	return s
+}
+
+// An Allocate request from user answering challenge
+func allocateRequest(challenge *msg.Message, user string) []byte {
+
+	realm, _ := challenge.Realm()
+	nonce, _ := challenge.Nonce()
+
+	req := msg.NewRequest(msg.Allocate | msg.Request)
+	req.AddAttribute(msg.NewRequestedTransport(msg.TransportUDP))
+	u, _ := msg.NewUser(user)
+	r, _ := msg.NewRealm(realm)
+	req.AddAttribute(u)
+	req.AddAttribute(r)
+	req.AddAttribute(nonce)
+	req.AddAttribute(msg.NewPasswordAlgorithm(msg.AlgorithmSHA256))
+	req.AddAttribute(msg.NewPasswordAlgorithms(PasswordAlgorithms...))
+
+	key := msg.PasswordKey(msg.AlgorithmSHA256, user, realm, "pass")
+	req.AddAttribute(msg.NewIntegritySHA256(key, req))
+	return req.EncodeMessage()
+}
+
+// Sends data from port on 127.0.0.1 and returns the answer
+func allocateFrom(t *testing.T, s *Server, port int, data []byte) *msg.Message {
+
+	pc := &fakePacketConn{}
+	handleFrom(s, pc, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, data)
+
+	res := &msg.Message{}
+	if err := res.UnmarshalBinary(pc.last); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestRelayNeedsAuthenticator(t *testing.T) {
+	if err := NewServer(0, nil, nil).EnableRelay(net.IPv4(127, 0, 0, 1)); err != ErrNoAuthenticator {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// RFC 5766 section 6.2, Allocate requests must be authenticated
+func TestAllocateChallenged(t *testing.T) {
+
+	req := msg.NewRequest(msg.Allocate | msg.Request)
+	req.AddAttribute(msg.NewRequestedTransport(msg.TransportUDP))
+
+	res := allocateFrom(t, newRelayServer(t), 1000, req.EncodeMessage())
+	if code := errorCode(t, res); code != msg.Unauthorized {
+		t.Fatalf("unsigned Allocate answered with %d", code)
+	}
+}
+
+func TestUserQuota(t *testing.T) {
+
+	s := newRelayServer(t)
+	s.SetAllocationQuota(2, 0)
+	challenge := challengeFor(t, s)
+
+	for port := 1000; port < 1002; port++ {
+		res := allocateFrom(t, s, port, allocateRequest(challenge, "user"))
+		if res.Type() != msg.Allocate|msg.Success {
+			t.Fatalf("allocation %d answered with %d", port, errorCode(t, res))
+		}
+	}
+
+	res := allocateFrom(t, s, 1002, allocateRequest(challenge, "user"))
+	if code := errorCode(t, res); code != msg.AllocationQuota {
+		t.Fatalf("allocation over quota answered with %d", code)
+	}
+
+	res = allocateFrom(t, s, 1003, allocateRequest(challenge, "other"))
+	if res.Type() != msg.Allocate|msg.Success {
+		t.Fatalf("another user's allocation answered with %d", errorCode(t, res))
+	}
+
+	// Freed allocations count no more
+	s.relay.remove(s.relay.get(&fakePacketConn{}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}))
+	res = allocateFrom(t, s, 1004, allocateRequest(challenge, "user"))
+	if res.Type() != msg.Allocate|msg.Success {
+		t.Fatalf("allocation after one was freed answered with %d", errorCode(t, res))
+	}
+}
+
+func TestTotalQuota(t *testing.T) {
+
+	s := newRelayServer(t)
+	s.SetAllocationQuota(0, 1)
+	challenge := challengeFor(t, s)
+
+	if res := allocateFrom(t, s, 1000, allocateRequest(challenge, "user")); res.Type() != msg.Allocate|msg.Success {
+		t.Fatalf("first allocation answered with %d", errorCode(t, res))
+	}
+
+	res := allocateFrom(t, s, 1001, allocateRequest(challenge, "other"))
+	if code := errorCode(t, res); code != msg.AllocationQuota {
+		t.Fatalf("allocation over quota answered with %d", code)
+	}
+}
+
+// RFC 5766 section 6.2, a retransmitted Allocate gets the original response
+func TestAllocateRetransmitted(t *testing.T) {
+
+	s := newRelayServer(t)
+	req := allocateRequest(challengeFor(t, s), "user")
+
+	first := allocateFrom(t, s, 1000, req)
+	again := allocateFrom(t, s, 1000, req)
+	if first.Type() != msg.Allocate|msg.Success || again.Type() != msg.Allocate|msg.Success {
+		t.Fatalf("answered with %d, then %d", errorCode(t, first), errorCode(t, again))
+	}
+
+	if !bytes.Equal(first.EncodeMessage(), again.EncodeMessage()) {
+		t.Errorf("retransmission answered with\n%v\nnot\n%v", again, first)
+	}
+	if _, err := again.Attribute(msg.Lifetime); err != nil {
+		t.Error("retransmission answered without LIFETIME")
+	}
+}
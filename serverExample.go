@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"github.com/ricochet2200/gun/server"
 	"log"
+	"os"
+	"os/signal"
 )
 
 type Authenticator struct {
@@ -31,10 +34,13 @@ func main() {
 	
 	go func() {
 		for conn := range c {
-			conn = conn
 			log.Println("Unrecognized: ", conn.IP(), conn.Port())
 		}
 	}()
 
-	server.Start()
+	// Finishes the transactions in flight on Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	log.Println(server.Serve(ctx))
 }